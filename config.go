@@ -1,62 +1,660 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 // Config is the internal representation of the yaml that determines what
 // the app listens to an enqueues
 type Config struct {
-	Redis RedisConfig `yaml:"redis"`
-	AWS   AWSConfig   `yaml:"aws"`
-	Queue QueueConfig `yaml:"queue"`
-	SQS   SQSConfig
+	Redis  RedisConfig   `yaml:"redis"`
+	AWS    AWSConfig     `yaml:"aws"`
+	Queue  QueueConfig   `yaml:"queue"`
+	Queues []QueueConfig `yaml:"queues"`
+	SQS    SQSConfig     `yaml:"sqs"`
+	HTTP   HTTPConfig    `yaml:"http"`
+
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+}
+
+// ConcurrencyConfig is a nested config for how much work scout does at once
+type ConcurrencyConfig struct {
+	Receivers int `yaml:"receivers"` // optional, receivers polling each queue, defaults to 1
+	Workers   int `yaml:"workers"`   // optional, workers enqueueing for every queue, defaults to 10
+}
+
+// The defaults for the concurrency settings
+const (
+	DefaultReceivers = 1
+	DefaultWorkers   = 10
+)
+
+// WithDefaults returns the settings with the defaults filled in
+func (c ConcurrencyConfig) WithDefaults() ConcurrencyConfig {
+	if c.Receivers == 0 {
+		c.Receivers = DefaultReceivers
+	}
+
+	if c.Workers == 0 {
+		c.Workers = DefaultWorkers
+	}
+
+	return c
+}
+
+// HTTPConfig is a nested config for the http listener that serves metrics
+type HTTPConfig struct {
+	Listen string `yaml:"listen"` // optional, address like ":9100", no listener if unset
 }
 
 // RedisConfig is a nested config that contains the necessary parameters to
 // connect to a redis instance and enqueue workers.
 type RedisConfig struct {
-	Host      string `yaml:"host"`
-	Queue     string `yaml:"queue"`
-	Namespace string `yaml:"namespace"` // optional
-	Password  string `yaml:"password"`  // optional
+	Host         string     `yaml:"host"`
+	Queue        string     `yaml:"queue"`
+	Namespace    string     `yaml:"namespace"`     // optional
+	Password     string     `yaml:"password"`      // optional
+	PasswordFile string     `yaml:"password_file"` // optional, read the password from a file
+	JobOptions   JobOptions `yaml:"job_options"`   // optional, defaults for every topic
+	Timeout      int64      `yaml:"timeout"`       // optional, seconds each redis call can take, defaults to 5
+}
+
+// DefaultRedisTimeout is used when redis.timeout isn't set
+const DefaultRedisTimeout = 5
+
+// CallTimeout returns how long each redis call can take
+func (r RedisConfig) CallTimeout() time.Duration {
+	if r.Timeout == 0 {
+		return DefaultRedisTimeout * time.Second
+	}
+
+	return time.Duration(r.Timeout) * time.Second
 }
 
 // AWSConfig is a nested config that contains the necessary parameters to
-// connect to AWS and read from SQS
+// connect to AWS and read from SQS. Without static keys, credentials come
+// from the SDK's default chain.
 type AWSConfig struct {
-	AccessKey string `yaml:"access_key"`
-	SecretKey string `yaml:"secret_key"`
-	Region    string `yaml:"region"`
+	AccessKey     string `yaml:"access_key"`      // optional, uses the default credential chain if unset
+	AccessKeyFile string `yaml:"access_key_file"` // optional, read the access key from a file
+	SecretKey     string `yaml:"secret_key"`      // optional, uses the default credential chain if unset
+	SecretKeyFile string `yaml:"secret_key_file"` // optional, read the secret key from a file
+	Region        string `yaml:"region"`
+	Profile       string `yaml:"profile"`     // optional, profile in the shared config files
+	RoleARN       string `yaml:"role_arn"`    // optional, role to assume with STS
+	ExternalID    string `yaml:"external_id"` // optional, external id for assuming the role
+	Endpoint      string `yaml:"endpoint"`    // optional, SQS endpoint for ElasticMQ, LocalStack, etc
 }
 
 // QueueConfig is a nested config that gives the SQS queue to listen on
 // and a mapping of topics to workeers
 type QueueConfig struct {
-	Name   string            `yaml:"name"`
-	Topics map[string]string `yaml:"topics"`
+	Name         string                 `yaml:"name"`
+	URL          string                 `yaml:"url"` // optional, skips looking up the url by name
+	Topics       map[string]TopicConfig `yaml:"topics"`
+	SidekiqQueue string                 `yaml:"sidekiq_queue"` // optional, defaults to redis.queue
+	SQS          SQSConfig              `yaml:"sqs"`           // optional, defaults to the global settings
+	Failures     FailureConfig          `yaml:"failures"`      // optional, defaults to deleting
+
+	// Raw queues get messages straight from SQS producers or raw SNS
+	// subscriptions rather than in an SNS envelope. They're routed by the
+	// value of a message attribute, or all go to a single worker.
+	Format         MessageFormat `yaml:"format"`          // optional, sns or raw, defaults to sns
+	RouteAttribute string        `yaml:"route_attribute"` // optional, raw only, attribute looked up in topics
+	Worker         *TopicConfig  `yaml:"worker"`          // optional, raw only, used when there's no attribute
+
+	// Routes send messages to workers based on their contents. They're
+	// checked before the topics, which are only used if no route matches.
+	Routes []RouteConfig `yaml:"routes"` // optional
+
+	Signatures SignatureConfig `yaml:"signatures"` // optional, sns only, defaults to not verifying
+}
+
+// SignatureConfig is a nested config for verifying the signatures on SNS
+// envelopes, so that only messages really sent by SNS are enqueued
+type SignatureConfig struct {
+	Verify    bool     `yaml:"verify"`
+	CertHosts []string `yaml:"cert_hosts"` // optional, hosts certs can be fetched from, defaults to SNS's
 }
 
-// SQSConfig is a nested config meant to be passed directly to the SQS client
+// DefaultCertHosts are the hosts SNS serves its signing certs from, which are
+// `sns.<region>.amazonaws.com`. The region has to end in a number so that
+// other services like `sns.s3.amazonaws.com` don't match
+var DefaultCertHosts = []string{"sns.*-*-[0-9].amazonaws.com", "sns.*-*-[0-9].amazonaws.com.cn"}
+
+// RouteConfig is a nested config that sends messages matching all of its
+// conditions to one or more workers. For SNS messages the attributes are the
+// SNS message attributes, and the fields are json paths like `data.id` in the
+// Message. For raw messages they're the SQS message attributes and the body.
+type RouteConfig struct {
+	Topic      string            `yaml:"topic"`      // optional, topic or route attribute value to match
+	Attributes map[string]string `yaml:"attributes"` // optional, message attributes to match
+	Fields     map[string]string `yaml:"fields"`     // optional, json paths in the payload to match
+	Workers    []TopicConfig     `yaml:"workers"`
+}
+
+// MessageFormat is the shape of the bodies of the messages on a queue
+type MessageFormat string
+
+// The formats a queue's messages can be in
+const (
+	// FormatSNS is an SNS envelope with the TopicArn and Message
+	FormatSNS MessageFormat = "sns"
+	// FormatRaw is just the message itself
+	FormatRaw MessageFormat = "raw"
+)
+
+// FailureClass is a reason a message can never be enqueued
+type FailureClass string
+
+// The classes of failures that have a policy
+const (
+	FailureInvalidBody      FailureClass = "invalid_body"
+	FailureMissingTopicARN  FailureClass = "missing_topic_arn"
+	FailureUnknownTopic     FailureClass = "unknown_topic"
+	FailureMissingRoute     FailureClass = "missing_route"
+	FailureInvalidSignature FailureClass = "invalid_signature"
+)
+
+// FailurePolicy is what to do with messages that can never be enqueued
+type FailurePolicy string
+
+// The policies for messages that can never be enqueued
+const (
+	// PolicyDelete deletes the message
+	PolicyDelete FailurePolicy = "delete"
+	// PolicyLeave leaves the message on the queue, for SQS's redrive policy
+	PolicyLeave FailurePolicy = "leave"
+	// PolicyDeadLetter forwards the message to the dead letter queue, then
+	// deletes it
+	PolicyDeadLetter FailurePolicy = "dead_letter"
+)
+
+// FailureConfig is a nested config that gives the policy for each class of
+// message that can never be enqueued
+type FailureConfig struct {
+	DeadLetterQueue  string        `yaml:"dead_letter_queue"` // name or url, required for dead_letter
+	InvalidBody      FailurePolicy `yaml:"invalid_body"`
+	MissingTopicARN  FailurePolicy `yaml:"missing_topic_arn"`
+	UnknownTopic     FailurePolicy `yaml:"unknown_topic"`
+	MissingRoute     FailurePolicy `yaml:"missing_route"`
+	InvalidSignature FailurePolicy `yaml:"invalid_signature"`
+}
+
+// policies maps each class of failure to its policy
+func (f FailureConfig) policies() map[FailureClass]FailurePolicy {
+	return map[FailureClass]FailurePolicy{
+		FailureInvalidBody:      f.InvalidBody,
+		FailureMissingTopicARN:  f.MissingTopicARN,
+		FailureUnknownTopic:     f.UnknownTopic,
+		FailureMissingRoute:     f.MissingRoute,
+		FailureInvalidSignature: f.InvalidSignature,
+	}
+}
+
+// PolicyFor returns the policy for a class of failure, which defaults to
+// deleting the message
+func (f FailureConfig) PolicyFor(class FailureClass) FailurePolicy {
+	if policy := f.policies()[class]; policy != "" {
+		return policy
+	}
+
+	return PolicyDelete
+}
+
+// DisplayName returns the queue's name, or its url if it doesn't have one
+func (q QueueConfig) DisplayName() string {
+	if q.Name != "" {
+		return q.Name
+	}
+
+	return q.URL
+}
+
+// TopicConfig is a nested config that says how messages from a topic are
+// enqueued. In yaml it's either just the worker class, or a map with the
+// class and its job options.
+type TopicConfig struct {
+	Class      string `yaml:"class"`
+	Queue      string `yaml:"queue"` // optional, defaults to the queue's sidekiq queue
+	JobOptions `yaml:",inline"`
+}
+
+// UnmarshalYAML lets a topic be given as a plain worker class for backwards
+// compatibility
+func (t *TopicConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var class string
+	if err := unmarshal(&class); err == nil {
+		*t = TopicConfig{Class: class}
+		return nil
+	}
+
+	type plain TopicConfig
+	return unmarshal((*plain)(t))
+}
+
+// String returns a short human readable description of the topic's job
+func (t TopicConfig) String() string {
+	desc := t.Class
+	if t.Queue != "" {
+		desc += " (queue: " + t.Queue + ")"
+	}
+
+	return desc
+}
+
+// JobOptions are the sidekiq options jobs are enqueued with. They can be set
+// globally under redis.job_options and overridden per topic. Anything left
+// unset uses sidekiq's defaults, except retry which defaults to true.
+type JobOptions struct {
+	Retry     *BoolOrInt    `yaml:"retry"`     // true, false or the max number of retries
+	Dead      *bool         `yaml:"dead"`      // false skips the dead set after the last retry
+	Backtrace *BoolOrInt    `yaml:"backtrace"` // true, false or the number of lines to keep
+	In        time.Duration `yaml:"in"`        // schedule the job this far in the future
+	At        time.Time     `yaml:"at"`        // schedule the job at this time
+}
+
+// Merge returns a copy of the options with anything set in override
+// replacing the current value
+func (o JobOptions) Merge(override JobOptions) JobOptions {
+	if override.Retry != nil {
+		o.Retry = override.Retry
+	}
+
+	if override.Dead != nil {
+		o.Dead = override.Dead
+	}
+
+	if override.Backtrace != nil {
+		o.Backtrace = override.Backtrace
+	}
+
+	if override.In != 0 {
+		o.In = override.In
+	}
+
+	if !override.At.IsZero() {
+		o.At = override.At
+	}
+
+	return o
+}
+
+// BoolOrInt is a sidekiq option that can either be a bool, or a number that
+// implies true, like `retry: 5`
+type BoolOrInt struct {
+	Enabled bool
+	Count   int
+}
+
+// UnmarshalYAML accepts either a bool or an int
+func (b *BoolOrInt) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var count int
+	if err := unmarshal(&count); err == nil {
+		*b = BoolOrInt{Enabled: count > 0, Count: count}
+		return nil
+	}
+
+	var enabled bool
+	if err := unmarshal(&enabled); err != nil {
+		return err
+	}
+
+	*b = BoolOrInt{Enabled: enabled}
+	return nil
+}
+
+// MarshalJSON writes the option the way sidekiq expects it
+func (b BoolOrInt) MarshalJSON() ([]byte, error) {
+	if b.Count > 0 {
+		return json.Marshal(b.Count)
+	}
+
+	return json.Marshal(b.Enabled)
+}
+
+// SQSConfig is a nested config meant to be passed directly to the SQS client.
+// Zero values are treated as unset, except for wait_time_seconds where 0
+// turns off long polling.
 type SQSConfig struct {
-	maxNumberOfMessages int64 `yaml:"max_number_of_messages"`
-	waitTimeSeconds     int64 `yaml:"wait_time_seconds"`
-	visibilityTimeout   int64 `yaml:"visibility_timeout"`
+	MaxNumberOfMessages int64  `yaml:"max_number_of_messages"` // 1-10, defaults to 10
+	WaitTimeSeconds     *int64 `yaml:"wait_time_seconds"`      // 0-20, defaults to 20
+	VisibilityTimeout   int64  `yaml:"visibility_timeout"`     // up to 12 hours, defaults to the queue's
+
+	// The visibility timeout of messages that are still being processed is
+	// extended every heartbeat_interval seconds, for at most
+	// max_visibility_extension seconds after they were received
+	HeartbeatInterval      int64 `yaml:"heartbeat_interval"`       // up to 12 hours, disabled if unset
+	MaxVisibilityExtension int64 `yaml:"max_visibility_extension"` // up to 12 hours, defaults to 12 hours
+
+	// Messages that fail to enqueue are hidden for backoff_base seconds,
+	// doubling on every receive up to backoff_max, with some jitter
+	BackoffBase int64 `yaml:"backoff_base"` // up to 12 hours, defaults to 1 second
+	BackoffMax  int64 `yaml:"backoff_max"`  // up to 12 hours, defaults to 10 minutes
+
+	// Each SQS call is cancelled if it takes longer than request_timeout
+	// seconds. Receives get wait_time_seconds on top of that
+	RequestTimeout int64 `yaml:"request_timeout"` // up to 1 hour, defaults to 10 seconds
+}
+
+// DefaultMaxNumberOfMessages is used when max_number_of_messages isn't set
+const DefaultMaxNumberOfMessages = 10
+
+// DefaultWaitTimeSeconds is used when wait_time_seconds isn't set. It's the
+// longest SQS allows, so idle queues are long polled rather than hammered
+// with empty receives
+const DefaultWaitTimeSeconds = 20
+
+// DefaultBackoffBase and DefaultBackoffMax are used when backoff_base and
+// backoff_max aren't set
+const (
+	DefaultBackoffBase = 1
+	DefaultBackoffMax  = 10 * 60
+)
+
+// DefaultRequestTimeout is used when request_timeout isn't set
+const DefaultRequestTimeout = 10
+
+// maxRequestTimeout is the longest request_timeout can be, an hour
+const maxRequestTimeout = 60 * 60
+
+// maxVisibilityTimeout is the longest SQS will keep a message hidden, 12 hours
+const maxVisibilityTimeout = 12 * 60 * 60
+
+// sqsSetting describes a single SQS setting, the environment variable that
+// overrides it and the range SQS accepts for it. Settings where zero means
+// something are pointers, in optional, and are unset when nil
+type sqsSetting struct {
+	key      string
+	env      string
+	value    *int64
+	optional **int64
+	min, max int64
+}
+
+// get returns the value of the setting and whether it's set
+func (s sqsSetting) get() (int64, bool) {
+	if s.optional != nil {
+		if *s.optional == nil {
+			return 0, false
+		}
+
+		return **s.optional, true
+	}
+
+	return *s.value, *s.value != 0
+}
+
+// set sets the value of the setting
+func (s sqsSetting) set(n int64) {
+	if s.optional != nil {
+		*s.optional = &n
+		return
+	}
+
+	*s.value = n
+}
+
+func (s *SQSConfig) settings() []sqsSetting {
+	return []sqsSetting{
+		{key: "max_number_of_messages", env: "SCOUT_SQS_MAX_NUMBER_OF_MESSAGES", value: &s.MaxNumberOfMessages, min: 1, max: 10},
+		{key: "wait_time_seconds", env: "SCOUT_SQS_WAIT_TIME_SECONDS", optional: &s.WaitTimeSeconds, min: 0, max: 20},
+		{key: "visibility_timeout", env: "SCOUT_SQS_VISIBILITY_TIMEOUT", value: &s.VisibilityTimeout, min: 0, max: maxVisibilityTimeout},
+		{key: "heartbeat_interval", env: "SCOUT_SQS_HEARTBEAT_INTERVAL", value: &s.HeartbeatInterval, min: 0, max: maxVisibilityTimeout},
+		{key: "max_visibility_extension", env: "SCOUT_SQS_MAX_VISIBILITY_EXTENSION", value: &s.MaxVisibilityExtension, min: 0, max: maxVisibilityTimeout},
+		{key: "backoff_base", env: "SCOUT_SQS_BACKOFF_BASE", value: &s.BackoffBase, min: 0, max: maxVisibilityTimeout},
+		{key: "backoff_max", env: "SCOUT_SQS_BACKOFF_MAX", value: &s.BackoffMax, min: 0, max: maxVisibilityTimeout},
+		{key: "request_timeout", env: "SCOUT_SQS_REQUEST_TIMEOUT", value: &s.RequestTimeout, min: 0, max: maxRequestTimeout},
+	}
 }
 
 // ReadConfig reads from a file with the given name and returns a config or
-// an error if the file was unable to be parsed. It does no error checking
-// as far as required fields.
+// an error if the file was unable to be parsed. Environment variables in the
+// file are interpolated first. It does no error checking as far as required
+// fields and doesn't read any *_file secrets, use LoadConfig for that.
 func ReadConfig(file string) (*Config, error) {
-	data, err := os.ReadFile(file)
+	data, _, err := readConfigFile(file)
 	if err != nil {
 		return nil, err
 	}
 
+	return parseConfig(data)
+}
+
+// readConfigFile reads the file with the given name and interpolates any
+// environment variables in it. It also returns the names of any variables
+// that weren't set and had no default.
+func readConfigFile(file string) ([]byte, []string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return interpolate(data)
+}
+
+// envPattern matches `${VAR}`, `${VAR:-default}` and the `$$` escape
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate replaces `${VAR}` with the value of the environment variable
+// VAR, and `${VAR:-default}` with the default when VAR is unset or empty.
+// `$$` is a literal `$`. Variables that are unset and have no default are
+// replaced with nothing and returned.
+//
+// Only string values are interpolated, after the yaml has been parsed, so
+// values can't change its structure and comments are left alone. The result
+// is the yaml again, with the values quoted however they need to be. Values
+// that weren't quoted can still become numbers or booleans
+func interpolate(data []byte) ([]byte, []string, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	if doc.Kind == 0 {
+		return data, nil, nil
+	}
+
+	var missing []string
+	interpolateNode(&doc, &missing)
+
+	result, err := yamlv3.Marshal(&doc)
+	return result, missing, err
+}
+
+// interpolateNode interpolates every string value under the node. Keys are
+// left as they are
+func interpolateNode(node *yamlv3.Node, missing *[]string) {
+	switch node.Kind {
+	case yamlv3.DocumentNode, yamlv3.SequenceNode:
+		for _, child := range node.Content {
+			interpolateNode(child, missing)
+		}
+	case yamlv3.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			interpolateNode(node.Content[i], missing)
+		}
+	case yamlv3.ScalarNode:
+		if node.ShortTag() != "!!str" {
+			return
+		}
+
+		value := interpolateString(node.Value, missing)
+		if value == node.Value {
+			return
+		}
+
+		node.Value = value
+		if node.Style == 0 {
+			// let unquoted values be read as whatever they look like now
+			node.Tag = ""
+		}
+	}
+}
+
+// interpolateString interpolates a single value, adding any variables that
+// are unset and have no default to missing
+func interpolateString(value string, missing *[]string) string {
+	return envPattern.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		groups := envPattern.FindStringSubmatch(match)
+		name, hasDefault, def := groups[1], groups[2] != "", groups[3]
+
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+
+		if hasDefault {
+			return def
+		}
+
+		if _, ok := os.LookupEnv(name); !ok {
+			*missing = append(*missing, name)
+		}
+
+		return ""
+	})
+}
+
+// readSecretFiles fills in any secrets that were given as a path to a file,
+// like a mounted kubernetes secret. It's an error to give both the value and
+// the file.
+func (c *Config) readSecretFiles() ValidationErrors {
+	var errs ValidationErrors
+
+	secrets := []struct {
+		path  string
+		value *string
+		file  string
+	}{
+		{"redis.password", &c.Redis.Password, c.Redis.PasswordFile},
+		{"aws.access_key", &c.AWS.AccessKey, c.AWS.AccessKeyFile},
+		{"aws.secret_key", &c.AWS.SecretKey, c.AWS.SecretKeyFile},
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+
+		if *secret.value != "" {
+			errs = append(errs, ValidationError{secret.path + "_file", "can't be set along with " + secret.path})
+			continue
+		}
+
+		data, err := os.ReadFile(secret.file)
+		if err != nil {
+			errs = append(errs, ValidationError{secret.path + "_file", err.Error()})
+			continue
+		}
+
+		*secret.value = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return errs
+}
+
+// applyEnv overrides the global SQS settings with any SCOUT_SQS_* environment
+// variables. Values that aren't valid are reported and ignored.
+func (c *Config) applyEnv() ValidationErrors {
+	var errs ValidationErrors
+
+	for _, setting := range c.SQS.settings() {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs = append(errs, ValidationError{setting.env, "must be an integer"})
+			continue
+		}
+
+		if n < setting.min || n > setting.max {
+			errs = append(errs, ValidationError{setting.env, fmt.Sprintf("must be between %d and %d", setting.min, setting.max)})
+			continue
+		}
+
+		setting.set(n)
+	}
+
+	return errs
+}
+
+func parseConfig(data []byte) (*Config, error) {
 	config := new(Config)
 
-	err = yaml.Unmarshal(data, config)
+	err := yaml.Unmarshal(data, config)
 	return config, err
 }
+
+// QueueConfigs returns every queue the config listens on. The single `queue`
+// key is kept for backwards compatibility and comes first if it's set.
+func (c *Config) QueueConfigs() []QueueConfig {
+	queues := make([]QueueConfig, 0, len(c.Queues)+1)
+	if c.Queue.Name != "" || c.Queue.URL != "" || len(c.Queue.Topics) > 0 {
+		queues = append(queues, c.Queue)
+	}
+
+	return append(queues, c.Queues...)
+}
+
+// SidekiqQueueFor returns the sidekiq queue that jobs from the given queue
+// are enqueued on
+func (c *Config) SidekiqQueueFor(queue QueueConfig) string {
+	if queue.SidekiqQueue != "" {
+		return queue.SidekiqQueue
+	}
+
+	return c.Redis.Queue
+}
+
+// SQSConfigFor returns the SQS settings for the given queue. Anything the
+// queue doesn't set falls back to the global settings, which have already
+// been overridden by the environment, and then to the defaults.
+func (c *Config) SQSConfigFor(queue QueueConfig) SQSConfig {
+	merged := c.SQS
+
+	mergedSettings := merged.settings()
+	for i, setting := range queue.SQS.settings() {
+		if value, ok := setting.get(); ok {
+			mergedSettings[i].set(value)
+		}
+	}
+
+	if merged.MaxNumberOfMessages == 0 {
+		merged.MaxNumberOfMessages = DefaultMaxNumberOfMessages
+	}
+
+	if merged.WaitTimeSeconds == nil {
+		wait := int64(DefaultWaitTimeSeconds)
+		merged.WaitTimeSeconds = &wait
+	}
+
+	if merged.BackoffBase == 0 {
+		merged.BackoffBase = DefaultBackoffBase
+	}
+
+	if merged.BackoffMax == 0 {
+		merged.BackoffMax = DefaultBackoffMax
+	}
+
+	if merged.RequestTimeout == 0 {
+		merged.RequestTimeout = DefaultRequestTimeout
+	}
+
+	return merged
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"gopkg.in/yaml.v2"
 )
 
 func TestConfig(t *testing.T) {
@@ -64,7 +68,7 @@ func (c *ConfigTestSuite) TestConfig_Valid() {
 	c.assert.Equal(config.Redis.Password, "")
 	c.assert.Equal(config.AWS.Region, "us_best")
 	c.assert.Equal(config.Queue.Name, "myapp_queue")
-	c.assert.Equal(config.Queue.Topics["foo_topic"], "FooWorker")
+	c.assert.Equal(config.Queue.Topics["foo_topic"].Class, "FooWorker")
 }
 
 var sparseConfig = `
@@ -101,3 +105,254 @@ func (c *ConfigTestSuite) TestConfig_RedisPass() {
 	c.assert.Equal(config.Redis.Password, "jsdf3-402341234")
 	c.assert.Equal(config.Redis.Host, "localhost:9000")
 }
+
+var multiQueueConfig = `
+redis:
+  host: "localhost:9000"
+  queue: "background"
+aws:
+  region: "us_best"
+sqs:
+  max_number_of_messages: 10
+  visibility_timeout: 30
+queue:
+  name: "legacy_queue"
+  topics:
+    legacy_topic: "LegacyWorker"
+queues:
+  - name: "orders_queue"
+    sidekiq_queue: "orders"
+    sqs:
+      visibility_timeout: 120
+    topics:
+      order_topic: "OrderWorker"
+  - name: "users_queue"
+    topics:
+      user_topic: "UserWorker"`
+
+func (c *ConfigTestSuite) TestConfig_MultipleQueues() {
+	c.WriteTemp(multiQueueConfig)
+	config, err := ReadConfig(c.tempfile.Name())
+	c.assert.NoError(err)
+
+	queues := config.QueueConfigs()
+	c.assert.Len(queues, 3)
+	c.assert.Equal("legacy_queue", queues[0].Name)
+	c.assert.Equal("orders_queue", queues[1].Name)
+	c.assert.Equal("users_queue", queues[2].Name)
+	c.assert.Equal("OrderWorker", queues[1].Topics["order_topic"].Class)
+
+	// sidekiq queue falls back to the redis config
+	c.assert.Equal("background", config.SidekiqQueueFor(queues[0]))
+	c.assert.Equal("orders", config.SidekiqQueueFor(queues[1]))
+
+	// sqs settings are merged with the global ones
+	c.assert.Equal(SQSConfig{MaxNumberOfMessages: 10, WaitTimeSeconds: aws.Int64(DefaultWaitTimeSeconds), VisibilityTimeout: 30, BackoffBase: DefaultBackoffBase, BackoffMax: DefaultBackoffMax, RequestTimeout: DefaultRequestTimeout}, config.SQSConfigFor(queues[0]))
+	c.assert.Equal(SQSConfig{MaxNumberOfMessages: 10, WaitTimeSeconds: aws.Int64(DefaultWaitTimeSeconds), VisibilityTimeout: 120, BackoffBase: DefaultBackoffBase, BackoffMax: DefaultBackoffMax, RequestTimeout: DefaultRequestTimeout}, config.SQSConfigFor(queues[1]))
+}
+
+func (c *ConfigTestSuite) TestConfig_NoQueues() {
+	c.WriteTemp(sparseConfig)
+	config, err := ReadConfig(c.tempfile.Name())
+	c.assert.NoError(err)
+
+	c.assert.Empty(config.QueueConfigs())
+}
+
+var topicOptionsConfig = `
+queue:
+  name: "myapp_queue"
+  topics:
+    foo-topic:
+      class: "FooWorker"
+      queue: "critical"
+    bar-topic:
+      class: "BarWorker"
+      queue: "low"
+      retry: false
+    baz-topic: "BazWorker"`
+
+func (c *ConfigTestSuite) TestConfig_TopicOptions() {
+	c.WriteTemp(topicOptionsConfig)
+	config, err := ReadConfig(c.tempfile.Name())
+	c.assert.NoError(err)
+
+	topics := config.Queue.Topics
+	c.assert.Equal(TopicConfig{Class: "FooWorker", Queue: "critical"}, topics["foo-topic"])
+	c.assert.Equal("low", topics["bar-topic"].Queue)
+	c.assert.False(topics["bar-topic"].Retry.Enabled)
+
+	// plain strings are still just the worker class
+	c.assert.Equal(TopicConfig{Class: "BazWorker"}, topics["baz-topic"])
+}
+
+var jobOptionsConfig = `
+redis:
+  host: "localhost:9000"
+  queue: "background"
+  job_options:
+    retry: 5
+    dead: false
+    backtrace: true
+queue:
+  name: "myapp_queue"
+  topics:
+    foo-topic:
+      class: "FooWorker"
+      retry: false
+      backtrace: 20
+      in: 30s
+    bar-topic:
+      class: "BarWorker"
+      at: 2030-01-02T03:04:05Z`
+
+func (c *ConfigTestSuite) TestConfig_JobOptions() {
+	c.WriteTemp(jobOptionsConfig)
+	config, err := ReadConfig(c.tempfile.Name())
+	c.assert.NoError(err)
+
+	global := config.Redis.JobOptions
+	c.assert.Equal(BoolOrInt{Enabled: true, Count: 5}, *global.Retry)
+	c.assert.False(*global.Dead)
+	c.assert.Equal(BoolOrInt{Enabled: true}, *global.Backtrace)
+
+	foo := config.Queue.Topics["foo-topic"]
+	c.assert.Equal(BoolOrInt{Enabled: false}, *foo.Retry)
+	c.assert.Equal(BoolOrInt{Enabled: true, Count: 20}, *foo.Backtrace)
+	c.assert.Equal(30*time.Second, foo.In)
+	c.assert.Nil(foo.Dead)
+
+	bar := config.Queue.Topics["bar-topic"]
+	c.assert.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), bar.At.UTC())
+
+	// topic options win over the global ones
+	merged := global.Merge(foo.JobOptions)
+	c.assert.Equal(BoolOrInt{Enabled: false}, *merged.Retry)
+	c.assert.False(*merged.Dead)
+	c.assert.Equal(20, merged.Backtrace.Count)
+}
+
+func TestBoolOrInt_JSON(t *testing.T) {
+	data, err := json.Marshal(BoolOrInt{Enabled: true, Count: 3})
+	require.NoError(t, err)
+	require.Equal(t, "3", string(data))
+
+	data, err = json.Marshal(BoolOrInt{Enabled: false})
+	require.NoError(t, err)
+	require.Equal(t, "false", string(data))
+}
+
+// interpolated interpolates the yaml and decodes the result
+func interpolated(t *testing.T, data string) (map[string]interface{}, []string) {
+	result, missing, err := interpolate([]byte(data))
+	require.NoError(t, err)
+
+	var values map[string]interface{}
+	require.NoError(t, yaml.Unmarshal(result, &values))
+	return values, missing
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("SCOUT_TEST_HOST", "redis:6379")
+	t.Setenv("SCOUT_TEST_EMPTY", "")
+
+	values, missing := interpolated(t, `host: "${SCOUT_TEST_HOST}"
+queue: "${SCOUT_TEST_QUEUE:-background}"
+namespace: "${SCOUT_TEST_EMPTY:-test}"
+password: "${SCOUT_TEST_MISSING}"
+other: "${SCOUT_TEST_EMPTY}"
+literal: "$${SCOUT_TEST_HOST} costs $5"`)
+
+	require.Equal(t, map[string]interface{}{
+		"host":      "redis:6379",
+		"queue":     "background",
+		"namespace": "test",
+		"password":  "",
+		"other":     "",
+		"literal":   "${SCOUT_TEST_HOST} costs $5",
+	}, values)
+
+	// only unset variables count as missing, empty ones are fine
+	require.Equal(t, []string{"SCOUT_TEST_MISSING"}, missing)
+}
+
+func TestInterpolate_Values(t *testing.T) {
+	t.Setenv("SCOUT_TEST_PASSWORD", `a"b\c #d`)
+	t.Setenv("SCOUT_TEST_TIMEOUT", "30")
+
+	values, missing := interpolated(t, `# set ${SCOUT_TEST_MISSING} to change it
+quoted: "${SCOUT_TEST_PASSWORD}"
+single: '${SCOUT_TEST_PASSWORD}'
+plain: ${SCOUT_TEST_PASSWORD}
+timeout: ${SCOUT_TEST_TIMEOUT}
+string: "${SCOUT_TEST_TIMEOUT}"
+list:
+  - x-${SCOUT_TEST_TIMEOUT}
+${SCOUT_TEST_TIMEOUT}: key # keys are left alone`)
+
+	// values can't break the yaml, whatever they have in them
+	require.Equal(t, map[string]interface{}{
+		"quoted":                `a"b\c #d`,
+		"single":                `a"b\c #d`,
+		"plain":                 `a"b\c #d`,
+		"timeout":               30,
+		"string":                "30",
+		"list":                  []interface{}{"x-30"},
+		"${SCOUT_TEST_TIMEOUT}": "key",
+	}, values)
+
+	// and comments aren't interpolated
+	require.Empty(t, missing)
+}
+
+func TestInterpolate_Empty(t *testing.T) {
+	result, missing, err := interpolate([]byte("# nothing here\n"))
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	config, err := parseConfig(result)
+	require.NoError(t, err)
+	require.Equal(t, &Config{}, config)
+}
+
+func (c *ConfigTestSuite) TestConfig_Interpolated() {
+	c.T().Setenv("SCOUT_TEST_SECRET", "shh")
+	c.WriteTemp(`
+aws:
+  secret_key: "${SCOUT_TEST_SECRET}"
+  region: "${SCOUT_TEST_REGION:-us-east-1}"`)
+
+	config, err := ReadConfig(c.tempfile.Name())
+	c.assert.NoError(err)
+	c.assert.Equal("shh", config.AWS.SecretKey)
+	c.assert.Equal("us-east-1", config.AWS.Region)
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := dir + "/password"
+	secretFile := dir + "/secret"
+	require.NoError(t, os.WriteFile(passwordFile, []byte("hunter2\n"), 0600))
+	require.NoError(t, os.WriteFile(secretFile, []byte("secret"), 0600))
+
+	config := &Config{
+		Redis: RedisConfig{PasswordFile: passwordFile},
+		AWS:   AWSConfig{SecretKeyFile: secretFile, AccessKey: "key"},
+	}
+
+	require.Empty(t, config.readSecretFiles())
+	require.Equal(t, "hunter2", config.Redis.Password)
+	require.Equal(t, "secret", config.AWS.SecretKey)
+	require.Equal(t, "key", config.AWS.AccessKey)
+
+	// can't set both, and the file has to exist
+	config = &Config{
+		Redis: RedisConfig{Password: "hunter2", PasswordFile: passwordFile},
+		AWS:   AWSConfig{SecretKeyFile: dir + "/missing"},
+	}
+
+	errs := config.readSecretFiles()
+	require.Len(t, errs, 2)
+	require.Equal(t, ValidationError{"redis.password_file", "can't be set along with redis.password"}, errs[0])
+	require.Equal(t, "aws.secret_key_file", errs[1].Path)
+}
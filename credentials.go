@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// roleSessionName identifies scout in CloudTrail when it assumes a role
+const roleSessionName = "scout"
+
+// NewAWSSession creates an AWS session from the given config. Static keys are
+// used if they're given, otherwise credentials come from the SDK's default
+// chain: environment variables, the shared config and credentials files
+// (using the given profile), web identity tokens, and ECS or EC2 roles. If a
+// role is given, those credentials are only used to assume it.
+func NewAWSSession(conf AWSConfig) (*session.Session, error) {
+	awsConfig := aws.Config{}
+
+	if conf.Region != "" {
+		awsConfig.Region = formatRegion(conf.Region)
+	}
+
+	if conf.AccessKey != "" || conf.SecretKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, "")
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           conf.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.RoleARN == "" {
+		return sess, nil
+	}
+
+	creds := stscreds.NewCredentials(sess, conf.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = roleSessionName
+		if conf.ExternalID != "" {
+			p.ExternalID = aws.String(conf.ExternalID)
+		}
+	})
+
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
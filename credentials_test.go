@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clearAWSEnv makes sure credentials from the environment running the tests
+// don't leak into them
+func clearAWSEnv(t *testing.T) {
+	for _, name := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+		"AWS_PROFILE", "AWS_DEFAULT_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION",
+		"AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE",
+	} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func TestAWSSession_Static(t *testing.T) {
+	clearAWSEnv(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "fromenv")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fromenv")
+
+	sess, err := NewAWSSession(AWSConfig{AccessKey: "super", SecretKey: "secret", Region: "us_best"})
+	require.NoError(t, err)
+	require.Equal(t, "us-best", *sess.Config.Region)
+
+	// static keys win over everything else
+	creds, err := sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	require.Equal(t, "super", creds.AccessKeyID)
+	require.Equal(t, "secret", creds.SecretAccessKey)
+}
+
+func TestAWSSession_DefaultChain(t *testing.T) {
+	clearAWSEnv(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "fromenv")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+
+	sess, err := NewAWSSession(AWSConfig{Region: "us-east-1"})
+	require.NoError(t, err)
+
+	creds, err := sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	require.Equal(t, "fromenv", creds.AccessKeyID)
+	require.Equal(t, "envsecret", creds.SecretAccessKey)
+}
+
+func TestAWSSession_Profile(t *testing.T) {
+	clearAWSEnv(t)
+
+	file := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(file, []byte(`
+[default]
+aws_access_key_id = defaultkey
+aws_secret_access_key = defaultsecret
+
+[scout]
+aws_access_key_id = scoutkey
+aws_secret_access_key = scoutsecret
+`), 0600)
+	require.NoError(t, err)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", file)
+
+	sess, err := NewAWSSession(AWSConfig{Region: "us-east-1", Profile: "scout"})
+	require.NoError(t, err)
+
+	creds, err := sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	require.Equal(t, "scoutkey", creds.AccessKeyID)
+}
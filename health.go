@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// health is what the health endpoints report on. It's global like the
+// signals, since the receivers, the queues and the http server all update it
+var health = newHealthState()
+
+// minPollAge is the shortest a receiver can go without finishing a poll
+// before it's considered stuck. It leaves room for a long poll and a batch
+// of slow enqueues
+const minPollAge = 2 * time.Minute
+
+// healthState tracks the receivers and the dependencies scout needs
+type healthState struct {
+	mu           sync.Mutex
+	started      time.Time
+	maxPollAge   time.Duration
+	polls        map[int]time.Time // when each receiver last finished a poll
+	nextReceiver int
+	queues       []string
+	receives     map[string]error // the result of each queue's last receive
+	stopping     bool
+	ping         func(timeout time.Duration) error
+	pingTimeout  time.Duration
+}
+
+func newHealthState() *healthState {
+	return &healthState{
+		started:    time.Now(),
+		maxPollAge: minPollAge,
+		polls:      make(map[int]time.Time),
+		receives:   make(map[string]error),
+	}
+}
+
+// Configure sets what the health checks look at: how to ping redis and how
+// long a ping can take, the longest receivers wait between polls and the
+// queues that have to be receiving. A receiver is alive as long as it's finished a poll in the last
+// 10 of those waits, or 2 minutes if that's longer
+func (h *healthState) Configure(ping func(time.Duration) error, pingTimeout, maxInterval time.Duration, queues []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ping, h.pingTimeout = ping, pingTimeout
+	h.maxPollAge = 10 * maxInterval
+	if h.maxPollAge < minPollAge {
+		h.maxPollAge = minPollAge
+	}
+	h.queues = queues
+}
+
+// StartReceiver adds a receiver that has to keep finishing polls to be
+// alive, counting from now. It returns the id to report its polls with
+func (h *healthState) StartReceiver(now time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := h.nextReceiver
+	h.nextReceiver++
+	h.polls[id] = now
+	return id
+}
+
+// Polled records that a receiver finished a poll
+func (h *healthState) Polled(id int, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.polls[id] = now
+}
+
+// StopReceiver removes a receiver once it's stopped polling
+func (h *healthState) StopReceiver(id int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.polls, id)
+}
+
+// Received records the result of a queue receiving from SQS
+func (h *healthState) Received(queue string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.receives[queue] = err
+}
+
+// Stopping marks scout as shutting down, so it's no longer ready
+func (h *healthState) Stopping() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopping = true
+}
+
+// healthCheck is the result of checking a single thing
+type healthCheck struct {
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	LastPoll *time.Time `json:"last_poll,omitempty"`
+}
+
+// healthReport is the json the health endpoints respond with
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// add adds a check to the report, which fails if the check does
+func (r *healthReport) add(name string, err error) {
+	check := healthCheck{Status: "ok"}
+	if err != nil {
+		check = healthCheck{Status: "fail", Error: err.Error()}
+		r.Status = "fail"
+	}
+
+	r.Checks[name] = check
+}
+
+func newHealthReport() *healthReport {
+	return &healthReport{Status: "ok", Checks: make(map[string]healthCheck)}
+}
+
+// Liveness reports whether every receiver has finished a poll recently, so
+// a single stuck one fails it. The last poll reported is the oldest one.
+// Before any receivers start, it counts from when scout started
+func (h *healthState) Liveness(now time.Time) *healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	check := healthCheck{Status: "ok"}
+	oldest := h.started
+	for _, polled := range h.polls {
+		if check.LastPoll == nil || polled.Before(oldest) {
+			oldest = polled
+			check.LastPoll = &oldest
+		}
+	}
+
+	report := newHealthReport()
+	if age := now.Sub(oldest); age > h.maxPollAge {
+		check.Status, check.Error = "fail", fmt.Sprintf("no poll in %s", age.Round(time.Second))
+		report.Status = "fail"
+	}
+	report.Checks["receivers"] = check
+
+	return report
+}
+
+// Readiness reports whether redis can be pinged and every queue's last
+// receive from SQS worked. It fails as soon as scout starts shutting down
+func (h *healthState) Readiness() *healthReport {
+	h.mu.Lock()
+	ping, pingTimeout, stopping := h.ping, h.pingTimeout, h.stopping
+	queues := append([]string(nil), h.queues...)
+	receives := make(map[string]error, len(h.receives))
+	for queue, err := range h.receives {
+		receives[queue] = err
+	}
+	h.mu.Unlock()
+
+	report := newHealthReport()
+
+	if stopping {
+		report.add("shutdown", errors.New("shutting down"))
+	} else {
+		report.add("shutdown", nil)
+	}
+
+	// ping without holding the lock, since it can be slow
+	if ping != nil {
+		report.add("redis", ping(pingTimeout))
+	}
+
+	sort.Strings(queues)
+	for _, queue := range queues {
+		err, ok := receives[queue]
+		if !ok {
+			err = errors.New("nothing received yet")
+		}
+		report.add("sqs:"+queue, err)
+	}
+
+	return report
+}
+
+// serveLiveness responds with the liveness report
+func serveLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, health.Liveness(time.Now()))
+}
+
+// serveReadiness responds with the readiness report
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, health.Readiness())
+}
+
+// writeHealthReport writes the report as json, with a 503 if it failed
+func writeHealthReport(w http.ResponseWriter, report *healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth_Liveness(t *testing.T) {
+	h := newHealthState()
+	h.Configure(nil, 0, time.Second, nil)
+
+	// before any receivers start it counts from when scout started
+	report := h.Liveness(h.started.Add(time.Minute))
+	require.Equal(t, "ok", report.Status)
+	require.Nil(t, report.Checks["receivers"].LastPoll)
+
+	report = h.Liveness(h.started.Add(3 * time.Minute))
+	require.Equal(t, "fail", report.Status)
+	require.Equal(t, "no poll in 3m0s", report.Checks["receivers"].Error)
+
+	start := h.started.Add(time.Minute)
+	first, second := h.StartReceiver(start), h.StartReceiver(start)
+	h.Polled(first, start.Add(2*time.Minute))
+	h.Polled(second, start.Add(3*time.Minute))
+	report = h.Liveness(start.Add(3 * time.Minute))
+	require.Equal(t, "ok", report.Status)
+	require.Equal(t, start.Add(2*time.Minute), *report.Checks["receivers"].LastPoll)
+
+	// a single stuck receiver fails it, even if the others are polling
+	h.Polled(second, start.Add(5*time.Minute))
+	report = h.Liveness(start.Add(5 * time.Minute))
+	require.Equal(t, "fail", report.Status)
+	require.Equal(t, "no poll in 3m0s", report.Checks["receivers"].Error)
+
+	// until it stops
+	h.StopReceiver(first)
+	require.Equal(t, "ok", h.Liveness(start.Add(5*time.Minute)).Status)
+
+	// slow polling gets more time
+	h.Configure(nil, 0, 30*time.Second, nil)
+	require.Equal(t, "ok", h.Liveness(start.Add(9*time.Minute)).Status)
+	require.Equal(t, "fail", h.Liveness(start.Add(11*time.Minute)).Status)
+}
+
+func TestHealth_Readiness(t *testing.T) {
+	var pingErr error
+	var pingTimeout time.Duration
+	h := newHealthState()
+	h.Configure(func(timeout time.Duration) error {
+		pingTimeout = timeout
+		return pingErr
+	}, 3*time.Second, time.Second, []string{"orders", "payments"})
+
+	h.Received("orders", nil)
+	report := h.Readiness()
+	require.Equal(t, "fail", report.Status)
+	require.Equal(t, map[string]healthCheck{
+		"shutdown":     {Status: "ok"},
+		"redis":        {Status: "ok"},
+		"sqs:orders":   {Status: "ok"},
+		"sqs:payments": {Status: "fail", Error: "nothing received yet"},
+	}, report.Checks)
+
+	// redis is pinged with the configured timeout
+	require.Equal(t, 3*time.Second, pingTimeout)
+
+	h.Received("payments", nil)
+	require.Equal(t, "ok", h.Readiness().Status)
+
+	h.Received("payments", errors.New("AccessDenied"))
+	pingErr = errors.New("connection refused")
+	report = h.Readiness()
+	require.Equal(t, "fail", report.Status)
+	require.Equal(t, healthCheck{Status: "fail", Error: "AccessDenied"}, report.Checks["sqs:payments"])
+	require.Equal(t, healthCheck{Status: "fail", Error: "connection refused"}, report.Checks["redis"])
+
+	// shutting down fails readiness even if everything else is fine
+	h.Received("payments", nil)
+	pingErr = nil
+	h.Stopping()
+	report = h.Readiness()
+	require.Equal(t, "fail", report.Status)
+	require.Equal(t, healthCheck{Status: "fail", Error: "shutting down"}, report.Checks["shutdown"])
+}
+
+func TestHTTP_Health(t *testing.T) {
+	defer func(h *healthState) { health = h }(health)
+	health = newHealthState()
+	health.Configure(func(time.Duration) error { return nil }, time.Second, time.Second, []string{"orders"})
+
+	server := httptest.NewServer(NewHTTPHandler())
+	defer server.Close()
+
+	get := func(path string) (int, healthReport) {
+		resp, err := http.Get(server.URL + path)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		var report healthReport
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+		return resp.StatusCode, report
+	}
+
+	code, report := get("/healthz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", report.Status)
+
+	code, report = get("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "fail", report.Checks["sqs:orders"].Status)
+
+	health.Received("orders", nil)
+	code, _ = get("/readyz")
+	require.Equal(t, http.StatusOK, code)
+}
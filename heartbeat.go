@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// heartbeat keeps extending the visibility timeout of messages while they're
+// still being processed, so they don't become visible again and get enqueued
+// a second time if redis is slow
+type heartbeat struct {
+	client   SQSClient
+	interval time.Duration
+	timeout  int64
+	deadline time.Time
+
+	mu       sync.Mutex
+	inFlight map[string]Message
+
+	// sending is held while a beat is talking to SQS, without holding mu
+	sending sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHeartbeat starts extending the visibility of the given messages every
+// heartbeat interval. It returns nil if heartbeats are disabled, which is
+// safe to use. Each beat hides the messages for the visibility timeout
+// again, so without one there are no heartbeats either, rather than ones
+// that could shorten the queue's own timeout
+func startHeartbeat(client SQSClient, conf SQSConfig, messages []Message) *heartbeat {
+	if conf.HeartbeatInterval <= 0 || conf.VisibilityTimeout <= 0 || len(messages) == 0 {
+		return nil
+	}
+
+	maxExtension := conf.MaxVisibilityExtension
+	if maxExtension == 0 {
+		maxExtension = maxVisibilityTimeout
+	}
+
+	h := newHeartbeat(
+		client,
+		messages,
+		time.Duration(conf.HeartbeatInterval)*time.Second,
+		conf.VisibilityTimeout,
+		time.Duration(maxExtension)*time.Second,
+	)
+
+	go h.run()
+	return h
+}
+
+func newHeartbeat(client SQSClient, messages []Message, interval time.Duration, timeout int64, maxExtension time.Duration) *heartbeat {
+	h := &heartbeat{
+		client:   client,
+		interval: interval,
+		timeout:  timeout,
+		deadline: time.Now().Add(maxExtension),
+		inFlight: make(map[string]Message, len(messages)),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, msg := range messages {
+		h.inFlight[msg.ReceiptHandle] = msg
+	}
+
+	return h
+}
+
+func (h *heartbeat) run() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-ticker.C:
+			if !h.beat(now) {
+				return
+			}
+		}
+	}
+}
+
+// beat extends every message that's still in flight, in batches. It returns
+// false once the messages can't be extended any further
+func (h *heartbeat) beat(now time.Time) bool {
+	h.sending.Lock()
+	defer h.sending.Unlock()
+
+	// only hold on to the messages while copying them, so removing one
+	// doesn't wait on SQS for the whole batch
+	h.mu.Lock()
+	messages := make([]Message, 0, len(h.inFlight))
+	for _, msg := range h.inFlight {
+		messages = append(messages, msg)
+	}
+	h.mu.Unlock()
+
+	timeout := h.timeout
+	if remaining := int64(h.deadline.Sub(now) / time.Second); remaining < timeout {
+		timeout = remaining
+	}
+
+	if timeout <= 0 {
+		for _, msg := range messages {
+			log.WithField("MessageID", msg.MessageID).Warn("Reached max visibility extension, message may be processed twice")
+		}
+		return false
+	}
+
+	if len(messages) == 0 {
+		return true
+	}
+
+	failed := h.client.ChangeVisibilityBatch(context.Background(), messages, timeout)
+	for _, f := range failed {
+		log.WithField("MessageID", f.Message.MessageID).Warn("Couldn't extend visibility timeout: ", f.Err.Error())
+	}
+	log.Debugf("Extended visibility timeout of %d message(s) by %d seconds", len(messages)-len(failed), timeout)
+
+	return true
+}
+
+// Remove stops extending a message, once it's done with. If a beat is
+// already extending it, Remove waits for that to finish, so the caller's own
+// visibility change isn't undone by it
+func (h *heartbeat) Remove(msg Message) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	delete(h.inFlight, msg.ReceiptHandle)
+	h.mu.Unlock()
+
+	h.sending.Lock()
+	defer h.sending.Unlock()
+}
+
+// Stop stops extending all of the messages. It waits for any beat that's in
+// progress, so nothing is extended once it returns
+func (h *heartbeat) Stop() {
+	if h == nil {
+		return
+	}
+
+	close(h.stop)
+	<-h.done
+}
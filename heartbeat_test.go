@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeat_Disabled(t *testing.T) {
+	client := new(MockSQSClient)
+	messages := []Message{{MessageID: "a", ReceiptHandle: "a"}}
+
+	// no interval means no heartbeat, and the nil heartbeat is safe to use
+	h := startHeartbeat(client, SQSConfig{VisibilityTimeout: 30}, messages)
+	require.Nil(t, h)
+	h.Remove(messages[0])
+	h.Stop()
+
+	// same with no messages
+	require.Nil(t, startHeartbeat(client, SQSConfig{HeartbeatInterval: 10, VisibilityTimeout: 30}, nil))
+
+	// or no visibility timeout to extend by
+	require.Nil(t, startHeartbeat(client, SQSConfig{HeartbeatInterval: 10}, messages))
+}
+
+func TestHeartbeat_Extends(t *testing.T) {
+	client := new(MockSQSClient)
+	msgA := Message{MessageID: "a", ReceiptHandle: "a"}
+	msgB := Message{MessageID: "b", ReceiptHandle: "b"}
+
+	h := newHeartbeat(client, []Message{msgA, msgB}, 5*time.Millisecond, 30, time.Hour)
+	go h.run()
+
+	require.Eventually(t, func() bool {
+		return len(client.VisibilityChanges()) >= 2
+	}, time.Second, time.Millisecond)
+
+	require.Contains(t, client.VisibilityChanges(), VisibilityChange{msgA, 30})
+	require.Contains(t, client.VisibilityChanges(), VisibilityChange{msgB, 30})
+
+	// once a message is removed it isn't extended anymore
+	h.Remove(msgA)
+	count := len(client.VisibilityChanges())
+
+	require.Eventually(t, func() bool {
+		return len(client.VisibilityChanges()) > count
+	}, time.Second, time.Millisecond)
+
+	for _, change := range client.VisibilityChanges()[count:] {
+		require.Equal(t, msgB, change.Message)
+	}
+
+	// nothing is extended after stopping
+	h.Stop()
+	count = len(client.VisibilityChanges())
+	time.Sleep(20 * time.Millisecond)
+	require.Len(t, client.VisibilityChanges(), count)
+}
+
+func TestHeartbeat_MaxExtension(t *testing.T) {
+	client := new(MockSQSClient)
+	msg := Message{MessageID: "a", ReceiptHandle: "a"}
+
+	h := newHeartbeat(client, []Message{msg}, time.Second, 30, 10*time.Second)
+
+	// the last extension only goes up to the deadline
+	start := h.deadline.Add(-10 * time.Second)
+	require.True(t, h.beat(start))
+	require.True(t, h.beat(start.Add(5*time.Second)))
+	require.Equal(t, []VisibilityChange{{msg, 10}, {msg, 5}}, client.VisibilityChanges())
+
+	// past the deadline it gives up
+	require.False(t, h.beat(start.Add(11*time.Second)))
+	require.Len(t, client.VisibilityChanges(), 2)
+}
+
+func TestHeartbeat_Batched(t *testing.T) {
+	client := new(MockSQSClient)
+	messages := make([]Message, 12)
+	for i := range messages {
+		id := string(rune('a' + i))
+		messages[i] = Message{MessageID: id, ReceiptHandle: id}
+	}
+
+	// every message is extended in one call, and failures are only logged
+	client.VisibilityError = errors.New("throttled")
+	h := newHeartbeat(client, messages, time.Second, 30, time.Hour)
+	require.True(t, h.beat(time.Now()))
+	require.Equal(t, 1, client.VisibilityBatches)
+	require.Len(t, client.VisibilityChanges(), 12)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NewHTTPHandler returns the handler for scout's http endpoints
+func NewHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", serveLiveness)
+	mux.HandleFunc("/readyz", serveReadiness)
+	return mux
+}
+
+// StartHTTPServer listens on the configured address and serves the http
+// endpoints in the background. It returns an error if it can't listen, so a
+// port that's taken stops scout from starting
+func StartHTTPServer(conf HTTPConfig) (*http.Server, error) {
+	listener, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           NewHTTPHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("HTTP server stopped: ", err.Error())
+		}
+	}()
+
+	log.Info("Serving http on ", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP_Metrics(t *testing.T) {
+	metrics.MessagesFetched.WithLabelValues("http_test").Add(3)
+	fetched := testutil.ToFloat64(metrics.MessagesFetched.WithLabelValues("http_test"))
+
+	server := httptest.NewServer(NewHTTPHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	require.Contains(t, string(body), "# TYPE scout_messages_fetched_total counter")
+	require.Contains(t, string(body), fmt.Sprintf(`scout_messages_fetched_total{queue="http_test"} %g`, fetched))
+}
+
+func TestStartHTTPServer(t *testing.T) {
+	server, err := StartHTTPServer(HTTPConfig{Listen: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer server.Close()
+
+	// a port that's taken is an error
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+
+	_, err = StartHTTPServer(HTTPConfig{Listen: listener.Addr().String()})
+	require.NotNil(t, err)
+}
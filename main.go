@@ -2,10 +2,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,15 +18,20 @@ import (
 var (
 	app     *cli.App
 	signals chan os.Signal
+	reloads chan os.Signal
 )
 
+// stopSignals are the signals that stop scout, or a replay
+var stopSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT}
+
 func init() {
 	app = cli.NewApp()
 
 	app.Name = "scout"
 	app.Usage = `SQS Listener
 Poll SQS queues specified in a config and enqueue Sidekiq jobs with the queue items.
-It gracefully stops when sent SIGTERM.`
+It gracefully stops when sent SIGTERM, SIGINT or SIGQUIT, and exits right away on a second one.
+It reloads the topics and workers from the config when sent SIGHUP.`
 
 	app.Version = "v1.6.0"
 
@@ -36,7 +43,21 @@ It gracefully stops when sent SIGTERM.`
 		cli.Int64Flag{
 			Name:  "freq, f",
 			Value: 100,
-			Usage: "Poll SQS every `N` milliseconds",
+			Usage: "Poll SQS every `N` milliseconds, or right away after a full batch",
+		},
+		cli.Int64Flag{
+			Name:  "max-freq, m",
+			Value: 5000,
+			Usage: "Back off to polling every `N` milliseconds while a queue is empty",
+		},
+		cli.Int64Flag{
+			Name:  "shutdown-timeout, s",
+			Value: 25,
+			Usage: "Give in-flight polls `N` seconds to finish when stopping, then release their messages",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "Log the jobs messages would be enqueued as, without enqueueing or deleting anything",
 		},
 		cli.StringFlag{
 			Name:  "log-level, l",
@@ -50,8 +71,40 @@ It gracefully stops when sent SIGTERM.`
 
 	app.Action = runApp
 
+	app.Commands = []cli.Command{
+		{
+			Name:      "validate",
+			Usage:     "Check a config file for problems and exit non-zero if there are any",
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "Validate the config in `FILE`, required",
+				},
+			},
+			Action: runValidate,
+		},
+		{
+			Name:      "replay",
+			Usage:     "Enqueue the messages in a file, one SNS envelope or raw body per line, and print a summary",
+			ArgsUsage: "MESSAGES",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "Load config from `FILE`, required",
+				},
+				cli.StringFlag{
+					Name:  "queue, q",
+					Usage: "Route messages like the queue named `NAME`, required if the config has more than one",
+				},
+			},
+			Action: runReplay,
+		},
+	}
+
+	// the channels only get signals once runApp starts listening
 	signals = make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGTERM)
+	reloads = make(chan os.Signal, 1)
 }
 
 func main() {
@@ -59,6 +112,9 @@ func main() {
 }
 
 func runApp(ctx *cli.Context) error {
+	signal.Notify(signals, stopSignals...)
+	signal.Notify(reloads, syscall.SIGHUP)
+
 	configFile := ctx.String("config")
 	frequency := ctx.Int64("freq")
 
@@ -82,57 +138,199 @@ func runApp(ctx *cli.Context) error {
 		return cli.NewExitError("Missing required flag --config. Run `scout --help` for more information", 1)
 	}
 
+	maxFrequency := ctx.Int64("max-freq")
+	if frequency <= 0 || maxFrequency < frequency {
+		return cli.NewExitError("--freq has to be positive, and no more than --max-freq", 1)
+	}
+
+	shutdownTimeout := ctx.Int64("shutdown-timeout")
+	if shutdownTimeout < 0 {
+		return cli.NewExitError("--shutdown-timeout can't be negative", 1)
+	}
+
 	log.Infof("Reading config from %s", configFile)
-	log.Infof("Polling every %d milliseconds", frequency)
+	log.Infof("Polling every %d to %d milliseconds", frequency, maxFrequency)
 
-	config, err := ReadConfig(configFile)
-	if err != nil {
+	config, err := LoadConfig(configFile)
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			log.Error("Invalid config: ", e.Error())
+		}
+		return cli.NewExitError("Config file is invalid. Run `scout validate` for more information", 1)
+	} else if err != nil {
 		return cli.NewExitError("Failed to parse config file", 1)
 	}
 
-	maxNumberOfMessages, _ := strconv.ParseInt(os.Getenv("SCOUT_SQS_MAX_NUMBER_OF_MESSAGES"), 10, 64)
-	if maxNumberOfMessages != 0 {
-		config.SQS.maxNumberOfMessages = maxNumberOfMessages
-	} else {
-		config.SQS.maxNumberOfMessages = 10
+	dryRun := ctx.Bool("dry-run")
+	if dryRun {
+		log.Warn("Dry run, nothing will be enqueued or deleted and messages are released right away")
 	}
 
-	waitTimeSeconds, _ := strconv.ParseInt(os.Getenv("SCOUT_SQS_WAIT_TIME_SECONDS"), 10, 64)
-	if waitTimeSeconds != 0 {
-		config.SQS.waitTimeSeconds = waitTimeSeconds
+	queues, err := NewQueues(config, dryRun)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Initialization error: %s", err.Error()), 1)
 	}
 
-	visibilityTimeout, _ := strconv.ParseInt(os.Getenv("SCOUT_SQS_VISIBILITY_TIMEOUT"), 10, 64)
-	if visibilityTimeout != 0 {
-		config.SQS.visibilityTimeout = visibilityTimeout
+	var names []string
+	for _, queueConfig := range config.QueueConfigs() {
+		names = append(names, queueConfig.DisplayName())
+	}
+	// dry runs never connect to redis, so it can't be pinged
+	ping := PingRedis
+	if dryRun {
+		ping = nil
 	}
+	health.Configure(ping, config.Redis.CallTimeout(), time.Duration(maxFrequency)*time.Millisecond, names)
 
-	queue, err := NewQueue(config)
+	if config.HTTP.Listen != "" {
+		if _, err := StartHTTPServer(config.HTTP); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Couldn't start http server: %s", err.Error()), 1)
+		}
+	}
+
+	for _, queueConfig := range config.QueueConfigs() {
+		log.Info("Now listening on queue: ", queueConfig.DisplayName())
+		for name, topic := range queueConfig.Topics {
+			log.Infof("%s -> %s", name, topic)
+		}
+		if queueConfig.Worker != nil {
+			log.Infof("* -> %s", queueConfig.Worker)
+		}
+	}
+
+	reloadCtx, stopReloading := context.WithCancel(context.Background())
+	defer stopReloading()
+	go watchReloads(reloadCtx, configFile, config, queues)
+
+	err = Listen(queues, Schedule{
+		Receivers:   config.Concurrency.WithDefaults().Receivers,
+		Interval:    time.Duration(frequency) * time.Millisecond,
+		MaxInterval: time.Duration(maxFrequency) * time.Millisecond,
+	}, time.Duration(shutdownTimeout)*time.Second)
 	if err != nil {
-		return cli.NewExitError(fmt.Sprintf("Initialization error: %s", err.Error()), 1)
+		return cli.NewExitError(fmt.Sprintf("Didn't shut down cleanly: %s", err.Error()), 1)
 	}
 
-	log.Info("Now listening on queue: ", config.Queue.Name)
-	for topic, worker := range config.Queue.Topics {
-		log.Infof("%s -> %s", topic, worker)
+	return nil
+}
+
+// runValidate checks the given config file and prints every problem with it
+func runValidate(ctx *cli.Context) error {
+	configFile := ctx.String("config")
+	if configFile == "" {
+		configFile = ctx.GlobalString("config")
+	}
+
+	if configFile == "" {
+		return cli.NewExitError("Missing required flag --config. Run `scout validate --help` for more information", 1)
 	}
 
-	Listen(queue, time.Tick(time.Duration(frequency)*time.Millisecond))
+	_, err := LoadConfig(configFile)
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(ctx.App.Writer, e.Error())
+		}
+		return cli.NewExitError(fmt.Sprintf("Found %d problem(s) in %s", len(errs), configFile), 1)
+	} else if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to parse config file: %s", err.Error()), 1)
+	}
+
+	fmt.Fprintf(ctx.App.Writer, "%s is valid\n", configFile)
 	return nil
 }
 
-// Listen does the work. It only returns if we get a signal
-func Listen(queue Queue, freq <-chan time.Time) {
-	for {
+// releaseTimeout is how long polls get to release their messages once the
+// shutdown deadline has passed
+const releaseTimeout = 5 * time.Second
+
+// Listen does the work. Each queue gets a fixed number of receivers that
+// poll it on their own schedule. On a signal, it stops starting new polls
+// and gives the ones in flight until the shutdown timeout to finish, then
+// cancels them so they release their messages. It returns once every
+// receiver has finished, or with an error if they didn't in time or a
+// second signal forced it
+func Listen(queues []Queue, schedule Schedule, shutdownTimeout time.Duration) error {
+	// polls are cancelled at the deadline, receivers as soon as we're stopping
+	pollCtx, cancelPolls := context.WithCancel(context.Background())
+	defer cancelPolls()
+	receiveCtx, stopReceiving := context.WithCancel(pollCtx)
+	defer stopReceiving()
+
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		for r := 0; r < schedule.Receivers; r++ {
+			wg.Add(1)
+			go func(queue Queue) {
+				defer wg.Done()
+				receive(receiveCtx, pollCtx, queue, schedule)
+			}(queue)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	sig := <-signals
+	log.Infof("Got %s, waiting up to %s for polls to finish", sig, shutdownTimeout)
+	health.Stopping()
+	stopReceiving()
+	return shutdown(done, cancelPolls, shutdownTimeout)
+}
+
+// shutdown waits for the receivers to be done. Past the timeout it cancels
+// the polls, and gives them a little longer to release their messages
+func shutdown(done <-chan struct{}, cancelPolls context.CancelFunc, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case sig := <-signals:
+		return fmt.Errorf("got %s while shutting down, exiting right away", sig)
+	case <-deadline.C:
+		log.Warn("Polls didn't finish in time, releasing messages that haven't been enqueued")
+		cancelPolls()
+	}
+
+	release := time.NewTimer(releaseTimeout)
+	defer release.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case sig := <-signals:
+		return fmt.Errorf("got %s while shutting down, exiting right away", sig)
+	case <-release.C:
+		return errors.New("polls were still running after the shutdown timeout")
+	}
+}
+
+// receive polls the queue over and over until ctx is done, waiting between
+// polls for as long as the schedule says. Each poll runs with pollCtx, which
+// lasts until the shutdown deadline. Finishing a poll is what shows the
+// receiver is alive
+func receive(ctx, pollCtx context.Context, queue Queue, schedule Schedule) {
+	backoff := &pollBackoff{Schedule: schedule}
+	id := health.StartReceiver(time.Now())
+	defer health.StopReceiver(id)
+
+	for ctx.Err() == nil {
+		result := queue.Poll(pollCtx)
+		health.Polled(id, time.Now())
+
+		delay := backoff.next(result)
+		log.Debug("Polling again in ", delay)
+
+		timer := time.NewTimer(delay)
 		select {
-		case <-signals:
-			log.Info("Got TERM")
-			queue.Semaphore().Wait()
+		case <-ctx.Done():
+			timer.Stop()
 			return
-		case tick := <-freq:
-			log.Debug("Polling at: ", tick)
-			queue.Semaphore().Add(1)
-			go queue.Poll()
+		case <-timer.C:
 		}
 	}
 }
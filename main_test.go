@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -56,57 +58,52 @@ func TestLogLevel(t *testing.T) {
 
 // WaitQueue implements Queue
 type WaitQueue struct {
-	sem  *sync.WaitGroup
 	seq  chan int
 	wait chan int
 }
 
-func (w *WaitQueue) Semaphore() *sync.WaitGroup {
-	return w.sem
-}
-
 // Poll sends `1` on the sequence channel, then waits on `wait`, then sends `2`
-// then downs the semaphore.
-func (w *WaitQueue) Poll() {
-	defer w.sem.Done()
+func (w *WaitQueue) Poll(ctx context.Context) PollResult {
 	w.seq <- 1
 	<-w.wait
 	w.seq <- 2
+	return PollEmpty
+}
+
+// testSchedule has the given number of receivers, which only poll once
+// before a test is over unless the batches are full
+func testSchedule(receivers int) Schedule {
+	return Schedule{Receivers: receivers, Interval: time.Hour, MaxInterval: time.Hour}
 }
 
 // waitListen just calls listen and then sends `3 on the sequence channel when
 // the call exits
-func waitListen(q Queue, freq <-chan time.Time, seq chan int) {
-	Listen(q, freq)
+func waitListen(q Queue, seq chan int) {
+	Listen([]Queue{q}, testSchedule(1), time.Hour)
 	seq <- 3
 }
 
 // This test is pretty complicated because I'm basically using it to ensure that
 // the loop in Listen will only exit once all of the in flight work is done. The
 // basic structure of theis test is to have a mock whose call to Poll() blocks
-// until I send it a signal. We then send something on the ticker channel to
-// kick off a job (which blocks). Then we send on the signal channel to start
+// until I send it a signal. Listening kicks off a job right away (which
+// blocks). Then we send on the signal channel to start
 // the graceful exit. Then we tell the queue's Poll() to exit, and then the
 // Listen should exit. We use a separate sequence channel to ensure the order
 // of everything
 func TestSignals(t *testing.T) {
 	seq := make(chan int)
 	wait := make(chan int)
-	freq := make(chan time.Time)
 
 	queue := &WaitQueue{
-		sem:  new(sync.WaitGroup),
 		seq:  seq,
 		wait: wait,
 	}
 
 	// begin listening
-	go waitListen(queue, freq, seq)
+	go waitListen(queue, seq)
 
-	// send a tick, this should start a call to Poll()
-	freq <- time.Now()
-
-	// when that call starts, we should get `1` on the sequence channel
+	// when the first call starts, we should get `1` on the sequence channel
 	val := <-seq
 	require.Equal(t, val, 1)
 
@@ -124,3 +121,187 @@ func TestSignals(t *testing.T) {
 	val = <-seq
 	require.Equal(t, val, 3)
 }
+
+// Every queue should be polled, and Listen should only exit once all of
+// them have finished
+func TestSignals_MultipleQueues(t *testing.T) {
+	seq := make(chan int)
+	wait := make(chan int)
+
+	queueA := &WaitQueue{seq: seq, wait: wait}
+	queueB := &WaitQueue{seq: seq, wait: wait}
+
+	done := make(chan bool)
+	go func() {
+		Listen([]Queue{queueA, queueB}, testSchedule(1), time.Hour)
+		done <- true
+	}()
+
+	// both queues are polled right away
+	require.Equal(t, <-seq, 1)
+	require.Equal(t, <-seq, 1)
+
+	signals <- os.Interrupt
+
+	// let the first Poll() finish, Listen() is still waiting on the other
+	wait <- 1
+	require.Equal(t, <-seq, 2)
+
+	select {
+	case <-done:
+		t.Fatal("Listen exited before all queues were done")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	wait <- 1
+	require.Equal(t, <-seq, 2)
+	<-done
+}
+
+// CountQueue implements Queue, and counts how many polls are running at once
+type CountQueue struct {
+	mu      sync.Mutex
+	running int
+	most    int
+	polls   int
+	wait    chan int
+}
+
+func (c *CountQueue) Poll(ctx context.Context) PollResult {
+	c.mu.Lock()
+	c.running++
+	c.polls++
+	if c.running > c.most {
+		c.most = c.running
+	}
+	c.mu.Unlock()
+
+	<-c.wait
+
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+
+	return PollFull
+}
+
+func (c *CountQueue) counts() (running, most, polls int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running, c.most, c.polls
+}
+
+// Each receiver only runs one poll at a time, and polls again right away
+// after a full batch
+func TestListen_Receivers(t *testing.T) {
+	queue := &CountQueue{wait: make(chan int)}
+
+	done := make(chan bool)
+	go func() {
+		Listen([]Queue{queue}, testSchedule(2), time.Hour)
+		done <- true
+	}()
+
+	require.Eventually(t, func() bool {
+		running, _, _ := queue.counts()
+		return running == 2
+	}, time.Second, time.Millisecond)
+
+	// let a few polls through. The batches are full, so the receivers poll
+	// again without waiting the hour between polls
+	for i := 0; i < 10; i++ {
+		queue.wait <- 1
+	}
+
+	close(queue.wait)
+	signals <- os.Interrupt
+	<-done
+
+	_, most, polls := queue.counts()
+	require.Equal(t, 2, most)
+	require.GreaterOrEqual(t, polls, 10)
+}
+
+// Receivers show they're alive by finishing polls, and stop counting once
+// they've stopped
+func TestListen_Liveness(t *testing.T) {
+	defer func(h *healthState) { health = h }(health)
+	health = newHealthState()
+
+	queue := &CountQueue{wait: make(chan int)}
+
+	done := make(chan bool)
+	go func() {
+		Listen([]Queue{queue}, testSchedule(1), time.Hour)
+		done <- true
+	}()
+
+	require.Eventually(t, func() bool {
+		running, _, _ := queue.counts()
+		return running == 1
+	}, time.Second, time.Millisecond)
+
+	// the receiver is stuck in its first poll
+	require.Equal(t, "fail", health.Liveness(time.Now().Add(3*time.Minute)).Status)
+
+	before := time.Now()
+	queue.wait <- 1
+	require.Eventually(t, func() bool {
+		last := health.Liveness(time.Now()).Checks["receivers"].LastPoll
+		return last != nil && !last.Before(before)
+	}, time.Second, time.Millisecond)
+
+	close(queue.wait)
+	signals <- os.Interrupt
+	<-done
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	require.Empty(t, health.polls)
+}
+
+// StuckQueue implements Queue, and its polls only finish once they're
+// cancelled, or never if it ignores that
+type StuckQueue struct {
+	started chan bool
+	ignore  bool
+}
+
+func (s *StuckQueue) Poll(ctx context.Context) PollResult {
+	s.started <- true
+	if s.ignore {
+		select {}
+	}
+
+	<-ctx.Done()
+	return PollEmpty
+}
+
+// Polls that don't finish by the shutdown timeout are cancelled
+func TestSignals_Deadline(t *testing.T) {
+	queue := &StuckQueue{started: make(chan bool)}
+
+	done := make(chan error)
+	go func() {
+		done <- Listen([]Queue{queue}, testSchedule(1), 10*time.Millisecond)
+	}()
+
+	<-queue.started
+	signals <- syscall.SIGTERM
+	require.Nil(t, <-done)
+}
+
+// A second signal exits without waiting for polls
+func TestSignals_Forced(t *testing.T) {
+	queue := &StuckQueue{started: make(chan bool), ignore: true}
+
+	done := make(chan error)
+	go func() {
+		done <- Listen([]Queue{queue}, testSchedule(1), time.Hour)
+	}()
+
+	<-queue.started
+	signals <- syscall.SIGTERM
+	signals <- syscall.SIGINT
+	require.EqualError(t, <-done, "got interrupt while shutting down, exiting right away")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics is every metric scout exports. They're global since the queues,
+// clients and http server all share them
+var metrics = newScoutMetrics()
+
+// scoutMetrics are the metrics served on /metrics. They have a registry of
+// their own, so only scout's metrics are served
+type scoutMetrics struct {
+	Registry *prometheus.Registry
+
+	MessagesFetched  *prometheus.CounterVec
+	MessagesEnqueued *prometheus.CounterVec
+	MessagesDeleted  *prometheus.CounterVec
+	MessagesFailed   *prometheus.CounterVec
+	ParseErrors      *prometheus.CounterVec
+	UnknownTopics    *prometheus.CounterVec
+	RedisPush        *prometheus.HistogramVec
+	RedisErrors      *prometheus.CounterVec
+	SQSRequests      *prometheus.HistogramVec
+	SQSErrors        *prometheus.CounterVec
+	PollsInFlight    *prometheus.GaugeVec
+}
+
+func newScoutMetrics() *scoutMetrics {
+	m := &scoutMetrics{
+		Registry: prometheus.NewRegistry(),
+
+		MessagesFetched: newCounterVec("scout_messages_fetched_total",
+			"Messages fetched from SQS.", "queue"),
+		MessagesEnqueued: newCounterVec("scout_messages_enqueued_total",
+			"Jobs enqueued in sidekiq.", "queue", "topic", "class"),
+		MessagesDeleted: newCounterVec("scout_messages_deleted_total",
+			"Messages deleted from SQS.", "queue", "topic"),
+		MessagesFailed: newCounterVec("scout_messages_failed_total",
+			"Messages that couldn't be enqueued, by the reason they failed.", "queue", "topic", "class", "reason"),
+		ParseErrors: newCounterVec("scout_parse_errors_total",
+			"Messages that couldn't be parsed.", "queue", "reason"),
+		UnknownTopics: newCounterVec("scout_unknown_topics_total",
+			"Messages with no worker for their topic.", "queue", "topic"),
+		RedisPush: newHistogramVec("scout_redis_push_seconds",
+			"How long pushing a job to redis takes.", "queue"),
+		RedisErrors: newCounterVec("scout_redis_errors_total",
+			"Jobs that couldn't be pushed to redis.", "queue"),
+		SQSRequests: newHistogramVec("scout_sqs_request_seconds",
+			"How long SQS API calls take.", "queue", "operation"),
+		SQSErrors: newCounterVec("scout_sqs_errors_total",
+			"SQS API calls that failed.", "queue", "operation"),
+		PollsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "scout_polls_in_flight",
+			Help: "Polls that haven't finished, at most one per receiver.",
+		}, []string{"queue"}),
+	}
+
+	m.Registry.MustRegister(
+		m.MessagesFetched, m.MessagesEnqueued, m.MessagesDeleted, m.MessagesFailed,
+		m.ParseErrors, m.UnknownTopics, m.RedisPush, m.RedisErrors,
+		m.SQSRequests, m.SQSErrors, m.PollsInFlight,
+	)
+
+	return m
+}
+
+// Handler serves every metric in the prometheus text format
+func (m *scoutMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+}
+
+// newHistogramVec creates a histogram with the prometheus client's default
+// buckets, which suit request durations in seconds
+func newHistogramVec(name, help string, labels ...string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: prometheus.DefBuckets}, labels)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_Handler(t *testing.T) {
+	m := newScoutMetrics()
+	m.MessagesDeleted.WithLabelValues("jobs", "b").Inc()
+	m.MessagesDeleted.WithLabelValues("jobs", "a").Add(2)
+	m.PollsInFlight.WithLabelValues("jobs").Inc()
+
+	// label values are escaped the way prometheus reads them, which isn't
+	// the same as go's
+	m.MessagesDeleted.WithLabelValues("jobs", "quote\"d \\ new\nline é").Inc()
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := io.ReadAll(recorder.Body)
+	require.Nil(t, err)
+
+	require.Contains(t, string(body), `# HELP scout_messages_deleted_total Messages deleted from SQS.
+# TYPE scout_messages_deleted_total counter
+scout_messages_deleted_total{queue="jobs",topic="a"} 2
+scout_messages_deleted_total{queue="jobs",topic="b"} 1
+scout_messages_deleted_total{queue="jobs",topic="quote\"d \\ new\nline é"} 1
+`)
+	require.Contains(t, string(body), `scout_polls_in_flight{queue="jobs"} 1`)
+
+	// the global metrics aren't touched
+	require.Equal(t, float64(0), testutil.ToFloat64(metrics.MessagesDeleted.WithLabelValues("jobs", "a")))
+}
+
+func TestMetrics_WrongLabels(t *testing.T) {
+	m := newScoutMetrics()
+	require.Panics(t, func() {
+		m.MessagesFetched.WithLabelValues("jobs", "extra")
+	})
+}
+
+// counterDelta returns a func that gives how much the counter has changed
+// since counterDelta was called. The metrics are global, so tests compare
+// against where they started rather than zero
+func counterDelta(c *prometheus.CounterVec, labels ...string) func() float64 {
+	counter := c.WithLabelValues(labels...)
+	start := testutil.ToFloat64(counter)
+	return func() float64 {
+		return testutil.ToFloat64(counter) - start
+	}
+}
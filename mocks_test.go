@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"sync"
 )
 
 func MockMessage(body, topic string) Message {
@@ -18,14 +21,61 @@ func MockMessage(body, topic string) Message {
 	return Message{Body: string(data)}
 }
 
+// MockAttributedMessage is like MockMessage, with SNS message attributes
+func MockAttributedMessage(body, topic string, attributes map[string]string) Message {
+	attrs := make(map[string]snsAttribute, len(attributes))
+	for name, value := range attributes {
+		attrs[name] = snsAttribute{Type: "String", Value: value}
+	}
+
+	msg := map[string]interface{}{
+		"Message":           body,
+		"TopicArn":          topic,
+		"MessageAttributes": attrs,
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+
+	return Message{Body: string(data)}
+}
+
 type MockSQSClient struct {
 	Fetchable   []Message
 	FetchError  error
 	Deleted     []Message
 	DeleteError error
+	DeleteCalls int
+
+	// DeleteFailures is how many more times a message will fail to be
+	// deleted in a batch, by body
+	DeleteFailures map[string]int
+
+	Visibility        []VisibilityChange
+	VisibilityError   error
+	VisibilityBatches int // calls to ChangeVisibilityBatch
+
+	Sent      []SentMessage
+	SendError error
+
+	mu sync.Mutex
+}
+
+// SentMessage is a single call to Send
+type SentMessage struct {
+	Body       string
+	Attributes map[string]string
 }
 
-func (m *MockSQSClient) Fetch() ([]Message, error) {
+// VisibilityChange is a single call to ChangeVisibility
+type VisibilityChange struct {
+	Message Message
+	Timeout int64
+}
+
+func (m *MockSQSClient) Fetch(ctx context.Context) ([]Message, error) {
 	if m.FetchError != nil {
 		return nil, m.FetchError
 	}
@@ -33,18 +83,99 @@ func (m *MockSQSClient) Fetch() ([]Message, error) {
 	return m.Fetchable, nil
 }
 
-func (m *MockSQSClient) Delete(message Message) error {
+func (m *MockSQSClient) Delete(ctx context.Context, message Message) error {
+	m.DeleteCalls++
 	m.Deleted = append(m.Deleted, message)
 	return m.DeleteError
 }
 
+func (m *MockSQSClient) ChangeVisibility(ctx context.Context, message Message, timeout int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Visibility = append(m.Visibility, VisibilityChange{message, timeout})
+	return m.VisibilityError
+}
+
+// ChangeVisibilityBatch records a change for every message, like
+// ChangeVisibility. VisibilityError fails all of them
+func (m *MockSQSClient) ChangeVisibilityBatch(ctx context.Context, messages []Message, timeout int64) []MessageError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.VisibilityBatches++
+
+	var failed []MessageError
+	for i, message := range messages {
+		m.Visibility = append(m.Visibility, VisibilityChange{message, timeout})
+		if m.VisibilityError != nil {
+			failed = append(failed, MessageError{message, i, m.VisibilityError})
+		}
+	}
+
+	return failed
+}
+
+// VisibilityChanges returns every visibility change so far, batched or not
+func (m *MockSQSClient) VisibilityChanges() []VisibilityChange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]VisibilityChange(nil), m.Visibility...)
+}
+
+func (m *MockSQSClient) Send(ctx context.Context, body string, attributes map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.SendError != nil {
+		return m.SendError
+	}
+
+	m.Sent = append(m.Sent, SentMessage{body, attributes})
+	return nil
+}
+
+func (m *MockSQSClient) DeleteBatch(ctx context.Context, messages []Message) []MessageError {
+	m.DeleteCalls++
+
+	var failed []MessageError
+	for i, message := range messages {
+		if m.DeleteError != nil {
+			failed = append(failed, MessageError{message, i, m.DeleteError})
+			continue
+		}
+
+		if m.DeleteFailures[message.Body] > 0 {
+			m.DeleteFailures[message.Body]--
+			failed = append(failed, MessageError{message, i, errors.New("delete failed")})
+			continue
+		}
+
+		m.Deleted = append(m.Deleted, message)
+	}
+
+	return failed
+}
+
 type MockWorkerClient struct {
 	Enqueued     [][]string
+	Jobs         []Job
 	EnqueuedJID  string
 	EnqueueError error
+
+	mu sync.Mutex
 }
 
-func (m *MockWorkerClient) Push(class, args string) (string, error) {
-	m.Enqueued = append(m.Enqueued, []string{class, args})
+func (m *MockWorkerClient) Push(ctx context.Context, job Job) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.Jobs = append(m.Jobs, job)
+	m.Enqueued = append(m.Enqueued, []string{job.Class, job.Args})
 	return m.EnqueuedJID, m.EnqueueError
 }
@@ -0,0 +1,51 @@
+package main
+
+import "sync"
+
+// WorkerPool is a fixed number of goroutines that enqueue messages. It's
+// shared by every queue, so no matter how many messages are received at
+// once, only so many are being enqueued. Receivers wait for a free worker,
+// which keeps them from receiving more than can be handled
+type WorkerPool struct {
+	tasks chan func()
+}
+
+// NewWorkerPool starts a pool with the given number of workers
+func NewWorkerPool(size int) *WorkerPool {
+	pool := &WorkerPool{tasks: make(chan func())}
+	for i := 0; i < size; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+func (p *WorkerPool) work() {
+	for task := range p.tasks {
+		task()
+	}
+}
+
+// Run runs the tasks on the pool and waits for all of them to finish. It
+// blocks while every worker is busy. If the pool is nil, the tasks are run
+// one at a time right away
+func (p *WorkerPool) Run(tasks []func()) {
+	if p == nil {
+		for _, task := range tasks {
+			task()
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(tasks))
+	for _, task := range tasks {
+		task := task
+		p.tasks <- func() {
+			defer wg.Done()
+			task()
+		}
+	}
+
+	wg.Wait()
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"strings"
 	"sync"
 
@@ -12,122 +14,506 @@ import (
 // Queue is an encasulation for processing an SQS queue and enqueueing the
 // results in sidekiq
 type Queue interface {
-	// Poll gets the next batch of messages from SQS and processes them.
-	// When it's finished, it downs the sempahore
-	Poll()
-
-	// Semaphore returns the lock used to ensure that all the work is
-	// done before terminating the queue
-	Semaphore() *sync.WaitGroup
+	// Poll gets the next batch of messages from SQS and processes them. It
+	// only returns once they've all been enqueued and deleted, with how
+	// full the batch was. If the context is cancelled, messages that
+	// haven't been enqueued yet are released instead
+	Poll(ctx context.Context) PollResult
 }
 
+// PollResult is how full a batch of messages was, which decides how soon
+// the queue is polled again
+type PollResult int
+
+// The results of polling a queue
+const (
+	// PollEmpty means nothing was received, or receiving failed
+	PollEmpty PollResult = iota
+	// PollPartial means some messages were received, but not a full batch
+	PollPartial
+	// PollFull means a full batch was received, so there are probably more
+	PollFull
+)
+
 // queue is the actual implementation
 type queue struct {
-	WorkerClient WorkerClient
-	SQSClient    SQSClient
-	Topics       map[string]string
-	Sem          *sync.WaitGroup
+	Name           string
+	WorkerClient   WorkerClient
+	SQSClient      SQSClient
+	Topics         map[string]TopicConfig
+	SidekiqQueue   string
+	JobOptions     JobOptions
+	SQS            SQSConfig
+	Failures       FailureConfig
+	DeadLetter     SQSClient
+	Format         MessageFormat
+	RouteAttribute string
+	Worker         *TopicConfig
+	Routes         []RouteConfig
+	Verifier       *SignatureVerifier
+	Pool           *WorkerPool
+
+	// DryRun routes messages and logs the jobs they'd become, without
+	// enqueueing or deleting anything
+	DryRun bool
+
+	// mu guards the routing, which is everything setRouting sets, since it
+	// can be reloaded while messages are being enqueued
+	mu sync.RWMutex
 }
 
-// NewQueue creates a new Queue from the given Config. Returns an error if
-// something about the config is invalid
-func NewQueue(config *Config) (Queue, error) {
+// NewQueues creates a Queue for every SQS queue in the given Config. All of
+// the queues share a single WorkerClient and WorkerPool. In a dry run, redis
+// isn't connected to at all. Returns an error if something about the config
+// is invalid
+func NewQueues(config *Config, dryRun bool) ([]Queue, error) {
+	queueConfigs := config.QueueConfigs()
+	if len(queueConfigs) == 0 {
+		return nil, errors.New("No queues defined")
+	}
+
+	var workerClient WorkerClient
+	if !dryRun {
+		var err error
+		workerClient, err = NewRedisWorkerClient(config.Redis)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pool := NewWorkerPool(config.Concurrency.WithDefaults().Workers)
+
+	queues := make([]Queue, len(queueConfigs))
+	for i, queueConfig := range queueConfigs {
+		q, err := NewQueue(config, queueConfig, workerClient, pool)
+		if err != nil {
+			return nil, fmt.Errorf("queue %s: %s", queueConfig.DisplayName(), err.Error())
+		}
+
+		q.(*queue).DryRun = dryRun
+		queues[i] = q
+	}
+
+	return queues, nil
+}
+
+// NewQueue creates a new Queue for a single SQS queue from the given Config.
+// Returns an error if something about the config is invalid
+func NewQueue(config *Config, queueConfig QueueConfig, workerClient WorkerClient, pool *WorkerPool) (Queue, error) {
 	queue := new(queue)
-	var err error
+	queue.Name = queueConfig.DisplayName()
 
-	queue.SQSClient, err = NewAWSSQSClient(config.AWS, config.Queue.Name, config.SQS)
+	err := queue.setRouting(config, queueConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	queue.WorkerClient, err = NewRedisWorkerClient(config.Redis)
+	queue.Format = queueConfig.Format
+	queue.Verifier = NewSignatureVerifier(queueConfig.Signatures)
+
+	queue.SQS = config.SQSConfigFor(queueConfig)
+	queue.SQSClient, err = NewAWSSQSClient(config.AWS, queueConfig, queue.SQS)
 	if err != nil {
 		return nil, err
 	}
 
-	queue.Topics = config.Queue.Topics
-	if len(queue.Topics) == 0 {
-		return nil, errors.New("No topics defined")
+	queue.Failures = queueConfig.Failures
+	if dlq := queueConfig.Failures.DeadLetterQueue; dlq != "" {
+		queue.DeadLetter, err = NewAWSSQSClient(config.AWS, deadLetterQueueConfig(dlq), queue.SQS)
+		if err != nil {
+			return nil, fmt.Errorf("dead letter queue: %s", err.Error())
+		}
 	}
 
-	queue.Sem = new(sync.WaitGroup)
+	queue.WorkerClient = workerClient
+	queue.Pool = pool
 
 	return queue, nil
 }
 
-func (q *queue) Semaphore() *sync.WaitGroup {
-	return q.Sem
+// setRouting sets where messages go and the options their jobs get from the
+// config. It's all that can be reloaded
+func (q *queue) setRouting(config *Config, queueConfig QueueConfig) error {
+	sidekiqQueue := config.SidekiqQueueFor(queueConfig)
+	if sidekiqQueue == "" {
+		return errors.New("Sidekiq queue required")
+	}
+
+	if len(queueConfig.Topics) == 0 && len(queueConfig.Routes) == 0 && queueConfig.Worker == nil {
+		return errors.New("No topics defined")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.SidekiqQueue = sidekiqQueue
+	q.Topics = queueConfig.Topics
+	q.RouteAttribute = queueConfig.RouteAttribute
+	q.Worker = queueConfig.Worker
+	q.Routes = queueConfig.Routes
+	q.JobOptions = config.Redis.JobOptions
+
+	return nil
 }
 
-func (q *queue) Poll() {
-	if q.Sem != nil {
-		defer q.Sem.Done()
+// Reload swaps in the routing for this queue from a new config. Messages
+// that are already being enqueued finish with the old routing
+func (q *queue) Reload(config *Config) error {
+	for _, queueConfig := range config.QueueConfigs() {
+		if queueConfig.DisplayName() == q.Name {
+			return q.setRouting(config, queueConfig)
+		}
 	}
 
-	messages, err := q.SQSClient.Fetch()
+	return fmt.Errorf("queue %s isn't in the config anymore", q.Name)
+}
+
+func (q *queue) Poll(ctx context.Context) PollResult {
+	metrics.PollsInFlight.WithLabelValues(q.Name).Inc()
+	defer metrics.PollsInFlight.WithLabelValues(q.Name).Dec()
+
+	messages, err := q.SQSClient.Fetch(ctx)
 	if err != nil {
 		log.Error("Error fetching messages: ", err.Error())
 	}
+	metrics.MessagesFetched.WithLabelValues(q.Name).Add(float64(len(messages)))
+	health.Received(q.Name, err)
+
+	// keep the messages hidden until they're enqueued and deleted
+	heartbeat := startHeartbeat(q.SQSClient, q.SQS, messages)
 
-	for _, msg := range messages {
-		ctx := log.WithField("MessageID", msg.MessageID)
-		ctx.Info("Processing message")
-		deletable := q.enqueueMessage(msg, ctx)
-		if deletable {
-			q.deleteMessage(msg, ctx)
+	// enqueue the messages on the worker pool, and delete the ones that are
+	// done with in the same order they were received
+	done := make([]bool, len(messages))
+	topics := make([]string, len(messages))
+	tasks := make([]func(), len(messages))
+	for i := range messages {
+		i := i
+		tasks[i] = func() {
+			if ctx.Err() != nil {
+				heartbeat.Remove(messages[i])
+				q.abandonMessage(messages[i])
+				return
+			}
+
+			topics[i], done[i] = q.processMessage(ctx, messages[i], heartbeat)
+		}
+	}
+	q.Pool.Run(tasks)
+
+	deletable := make([]Message, 0, len(messages))
+	deletableTopics := make([]string, 0, len(messages))
+	for i, msg := range messages {
+		if done[i] {
+			deletable = append(deletable, msg)
+			deletableTopics = append(deletableTopics, topics[i])
+		}
+	}
+
+	heartbeat.Stop()
+	q.deleteMessages(deletable, deletableTopics)
+
+	switch {
+	case len(messages) == 0:
+		return PollEmpty
+	case int64(len(messages)) >= q.SQS.MaxNumberOfMessages:
+		return PollFull
+	default:
+		return PollPartial
+	}
+}
+
+// processMessage enqueues a single message, and releases or rejects it if
+// that fails. It returns the topic label the message is counted under, and
+// true if the message should be deleted
+func (q *queue) processMessage(pollCtx context.Context, msg Message, heartbeat *heartbeat) (string, bool) {
+	ctx := log.WithField("MessageID", msg.MessageID)
+	ctx.Info("Processing message")
+
+	topic, err := q.enqueueMessage(pollCtx, msg, ctx)
+	if q.DryRun {
+		heartbeat.Remove(msg)
+		q.skipMessage(msg, err, ctx)
+		return topic, false
+	}
+
+	if err == nil {
+		return topic, true
+	}
+
+	heartbeat.Remove(msg)
+
+	// the poll was cancelled partway through, so don't back off
+	if pollCtx.Err() != nil {
+		q.abandonMessage(msg)
+		return topic, false
+	}
+
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) {
+		q.releaseMessage(msg, ctx)
+		return topic, false
+	}
+
+	return topic, q.rejectMessage(pollCtx, msg, rejected, ctx)
+}
+
+// rejectMessage applies the queue's failure policy to a message that can
+// never be enqueued. It returns true if the message should be deleted
+func (q *queue) rejectMessage(pollCtx context.Context, msg Message, rejected *RejectedError, ctx log.FieldLogger) bool {
+	ctx = ctx.WithField("Failure", rejected.Class)
+
+	switch q.Failures.PolicyFor(rejected.Class) {
+	case PolicyLeave:
+		ctx.Warn(rejected.Error(), ", leaving it for the redrive policy")
+		return false
+	case PolicyDeadLetter:
+		if q.DeadLetter == nil {
+			ctx.Error(rejected.Error(), ", but there's no dead letter queue")
+			q.releaseMessage(msg, ctx)
+			return false
+		}
+
+		err := q.DeadLetter.Send(pollCtx, msg.Body, map[string]string{
+			"ScoutFailure":   string(rejected.Class),
+			"ScoutError":     rejected.Error(),
+			"ScoutMessageId": msg.MessageID,
+		})
+		if err != nil {
+			ctx.Error(rejected.Error(), ", and couldn't forward it to the dead letter queue: ", err.Error())
+			q.releaseMessage(msg, ctx)
+			return false
 		}
+
+		ctx.Warn(rejected.Error(), ", forwarded it to the dead letter queue")
+		return true
+	default:
+		ctx.Warn(rejected.Error(), ", deleting it")
+		return true
 	}
 }
 
-// deleteMessage deletes a single message from SQS
-func (q *queue) deleteMessage(msg Message, ctx log.FieldLogger) {
-	err := q.SQSClient.Delete(msg)
+// releaseMessage makes a message that failed to enqueue visible again after
+// a backoff, so transient failures are retried quickly and persistent ones
+// back off
+//
+// Releasing and deleting messages isn't tied to the poll's context, so they
+// still happen after it's cancelled. The request timeout bounds them instead
+func (q *queue) releaseMessage(msg Message, ctx log.FieldLogger) {
+	delay := backoff(msg.ReceiveCount, q.SQS.BackoffBase, q.SQS.BackoffMax)
+
+	err := q.SQSClient.ChangeVisibility(context.Background(), msg, delay)
 	if err != nil {
-		ctx.Error("Couldn't delete message: ", err.Error())
+		ctx.Error("Couldn't release message: ", err.Error())
 	} else {
-		ctx.Info("Deleted message")
+		ctx.Infof("Released message, retrying in %d seconds", delay)
 	}
 }
 
-// enqueueMessage pushes a single message from SQS into redis
-func (q *queue) enqueueMessage(msg Message, ctx log.FieldLogger) bool {
-	body := make(map[string]json.RawMessage)
-	err := json.Unmarshal([]byte(msg.Body), &body)
+// abandonMessage makes a message visible again right away, because we're
+// shutting down before it could be enqueued
+func (q *queue) abandonMessage(msg Message) {
+	ctx := log.WithField("MessageID", msg.MessageID)
+
+	err := q.SQSClient.ChangeVisibility(context.Background(), msg, 0)
 	if err != nil {
-		ctx.Warn("Message body could not be parsed: ", err.Error())
-		return true
+		ctx.Error("Couldn't release message while shutting down: ", err.Error())
+	} else {
+		ctx.Info("Released message while shutting down")
+	}
+}
+
+// skipMessage logs what would have happened to a message in a dry run, and
+// makes it visible again right away so the real consumer still gets it
+func (q *queue) skipMessage(msg Message, err error, ctx log.FieldLogger) {
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		ctx.WithField("Failure", rejected.Class).Infof("%s, failure policy is %s", rejected.Error(), q.Failures.PolicyFor(rejected.Class))
+	} else if err != nil {
+		ctx.Warn("Couldn't route message, it would be retried: ", err.Error())
 	}
 
-	var topicARN string
-	err = json.Unmarshal(body["TopicArn"], &topicARN)
+	err = q.SQSClient.ChangeVisibility(context.Background(), msg, 0)
 	if err != nil {
-		ctx.Warn("Topic ARN could not be parsed: ", err.Error())
-		return true
+		ctx.Error("Couldn't release message after dry run: ", err.Error())
+	} else {
+		ctx.Debug("Released message after dry run")
 	}
+}
 
-	workerClass, ok := q.Topics[topicName(topicARN)]
-	if !ok {
-		ctx.Warn("No worker for topic: ", topicName(topicARN))
-		return true
+// backoff returns how many seconds to wait before retrying a message that's
+// been received the given number of times. It doubles with every receive up
+// to max, and is jittered down by up to half so failures don't retry in step
+func backoff(receiveCount, base, max int64) int64 {
+	delay := base
+	for i := int64(1); i < receiveCount && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	if delay < 2 {
+		return delay
 	}
 
-	var bodyMessage string
-	err = json.Unmarshal(body["Message"], &bodyMessage)
+	return delay - rand.Int63n(delay/2+1)
+}
+
+// deleteAttempts is how many times we try to delete a message before leaving
+// it to become visible again
+const deleteAttempts = 2
+
+// deleteMessages deletes the messages from SQS in batches. Only the messages
+// that failed are logged and retried. Each delete is counted by the topic at
+// the same index
+func (q *queue) deleteMessages(messages []Message, topics []string) {
+	for attempt := 1; attempt <= deleteAttempts && len(messages) > 0; attempt++ {
+		failed := q.SQSClient.DeleteBatch(context.Background(), messages)
+
+		failedIndexes := make(map[int]bool, len(failed))
+		for _, f := range failed {
+			failedIndexes[f.Index] = true
+		}
+
+		for i, msg := range messages {
+			if !failedIndexes[i] {
+				log.WithField("MessageID", msg.MessageID).Info("Deleted message")
+				metrics.MessagesDeleted.WithLabelValues(q.Name, topics[i]).Inc()
+			}
+		}
+
+		retryMessages := make([]Message, len(failed))
+		retryTopics := make([]string, len(failed))
+		for i, f := range failed {
+			retryMessages[i], retryTopics[i] = f.Message, topics[f.Index]
+
+			ctx := log.WithField("MessageID", f.Message.MessageID)
+			if attempt < deleteAttempts {
+				ctx.Warn("Couldn't delete message, retrying: ", f.Err.Error())
+			} else {
+				ctx.Error("Couldn't delete message: ", f.Err.Error())
+			}
+		}
+
+		messages, topics = retryMessages, retryTopics
+	}
+}
+
+// RejectedError is returned for messages that can never be enqueued, like
+// ones that can't be parsed or have no worker. What happens to them depends on
+// the queue's failure policy for the class of failure
+type RejectedError struct {
+	Class FailureClass
+	Err   error
+}
+
+func (r *RejectedError) Error() string {
+	return r.Err.Error()
+}
+
+func reject(class FailureClass, format string, args ...interface{}) error {
+	return &RejectedError{Class: class, Err: fmt.Errorf(format, args...)}
+}
+
+// enqueueMessage pushes a single message from SQS into redis. It returns the
+// topic label for its metrics, and a RejectedError if the message can never
+// be enqueued, or any other error if enqueueing failed and should be
+// retried. In a dry run, the jobs are only logged
+//
+// A message can be routed to more than one worker. If any of them fail, the
+// whole message is retried, so the others may be enqueued more than once.
+func (q *queue) enqueueMessage(pollCtx context.Context, msg Message, ctx log.FieldLogger) (string, error) {
+	env, err := q.parse(msg, ctx)
 	if err != nil {
-		ctx.Warn("'Message' field could not be parsed: ", err.Error())
+		q.countFailure(err)
+		return topicUnknown, err
+	}
+
+	// only hold on to the routing while working out the jobs, so reloading
+	// doesn't have to wait on fetching certs or redis
+	q.mu.RLock()
+	topics, label, err := q.route(env)
+	jobs := make([]Job, len(topics))
+	for i, topic := range topics {
+		jobs[i] = q.jobFor(topic, env.Args)
 	}
+	q.mu.RUnlock()
 
-	jid, err := q.WorkerClient.Push(workerClass, bodyMessage)
 	if err != nil {
-		ctx.WithField("Class", workerClass).Error("Couldn't enqueue worker: ", err.Error())
-		return false
+		q.countFailure(err)
+		return label, err
+	}
+
+	if q.DryRun {
+		for _, job := range jobs {
+			ctx.WithFields(log.Fields{"Class": job.Class, "Queue": job.Queue, "Args": job.Args}).Info("Would enqueue job")
+		}
+		return label, nil
+	}
+
+	var pushErr error
+	for _, job := range jobs {
+		jid, err := q.WorkerClient.Push(pollCtx, job)
+		if err != nil {
+			ctx.WithField("Class", job.Class).Error("Couldn't enqueue worker: ", err.Error())
+			metrics.MessagesFailed.WithLabelValues(q.Name, label, job.Class, "enqueue").Inc()
+			pushErr = err
+			continue
+		}
+
+		metrics.MessagesEnqueued.WithLabelValues(q.Name, label, job.Class).Inc()
+		ctx.WithField("Args", env.Args).Info("Enqueued job: ", jid)
 	}
 
-	ctx.WithField("Args", bodyMessage).Info("Enqueued job: ", jid)
-	return true
+	return label, pushErr
 }
 
-func topicName(topicARN string) string {
-	toks := strings.Split(topicARN, ":")
-	return toks[len(toks)-1]
+// countFailure updates the metrics for a message that couldn't be routed.
+// They're all counted as an unknown topic, whatever the message says it is
+func (q *queue) countFailure(err error) {
+	reason := "error"
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		reason = string(rejected.Class)
+	}
+
+	metrics.MessagesFailed.WithLabelValues(q.Name, topicUnknown, "", reason).Inc()
+
+	switch FailureClass(reason) {
+	case FailureInvalidBody, FailureMissingTopicARN:
+		metrics.ParseErrors.WithLabelValues(q.Name, reason).Inc()
+	case FailureUnknownTopic:
+		metrics.UnknownTopics.WithLabelValues(q.Name, topicUnknown).Inc()
+	}
+}
+
+// jobFor builds the sidekiq job for a message on the given topic. The topic's
+// job options override the queue's, and retry defaults to true
+func (q *queue) jobFor(topic TopicConfig, args string) Job {
+	defaults := JobOptions{Retry: &BoolOrInt{Enabled: true}}
+
+	job := Job{
+		Queue:      q.SidekiqQueue,
+		Class:      topic.Class,
+		Args:       args,
+		JobOptions: defaults.Merge(q.JobOptions).Merge(topic.JobOptions),
+	}
+
+	if topic.Queue != "" {
+		job.Queue = topic.Queue
+	}
+
+	return job
+}
+
+// deadLetterQueueConfig turns the dead letter queue setting, which is either
+// a queue name or url, into a QueueConfig
+func deadLetterQueueConfig(dlq string) QueueConfig {
+	if strings.HasPrefix(dlq, "https://") || strings.HasPrefix(dlq, "http://") {
+		return QueueConfig{URL: dlq}
+	}
+
+	return QueueConfig{Name: dlq}
 }
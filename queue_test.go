@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"sync"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
@@ -44,7 +47,8 @@ func (q *QueueTestSuite) SetupTest() {
 
 	q.queue.WorkerClient = q.workerClient
 
-	q.queue.Topics = make(map[string]string)
+	q.queue.Topics = make(map[string]TopicConfig)
+	q.queue.SidekiqQueue = "background"
 }
 
 func (q *QueueTestSuite) TestQueue_Success() {
@@ -57,23 +61,92 @@ func (q *QueueTestSuite) TestQueue_Success() {
 	q.sqsClient.Fetchable = []Message{message1, message3, message2}
 
 	// make some topics
-	q.queue.Topics["topicA"] = "WorkerA"
-	q.queue.Topics["topicB"] = "WorkerB"
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+	q.queue.Topics["topicB"] = TopicConfig{Class: "WorkerB"}
 
 	// do the work
-	q.queue.Poll()
+	q.queue.Poll(context.Background())
 
 	// The workers should be enqueued
 	q.assert.Contains(q.workerClient.Enqueued, []string{"WorkerA", `{"foo":"bar"}`})
 	q.assert.Contains(q.workerClient.Enqueued, []string{"WorkerA", `{"bar":"baz"}`})
 	q.assert.Contains(q.workerClient.Enqueued, []string{"WorkerB", `{"key":"val"}`})
 
+	// Everything goes on the queue's sidekiq queue
+	for _, job := range q.workerClient.Jobs {
+		q.assert.Equal("background", job.Queue)
+		q.assert.True(job.Retry.Enabled)
+	}
+
 	// The messages should be deleted
 	q.assert.Contains(q.sqsClient.Deleted, message1)
 	q.assert.Contains(q.sqsClient.Deleted, message2)
 	q.assert.Contains(q.sqsClient.Deleted, message3)
 }
 
+func (q *QueueTestSuite) TestQueue_TopicRouting() {
+	message1 := MockMessage(`{"foo":"bar"}`, "topicA")
+	message2 := MockMessage(`{"bar":"baz"}`, "topicB")
+	message3 := MockMessage(`{"key":"val"}`, "topicC")
+
+	q.sqsClient.Fetchable = []Message{message1, message2, message3}
+
+	// each topic can go to its own sidekiq queue
+	noRetry := JobOptions{Retry: &BoolOrInt{Enabled: false}}
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA", Queue: "critical"}
+	q.queue.Topics["topicB"] = TopicConfig{Class: "WorkerB", Queue: "low", JobOptions: noRetry}
+	q.queue.Topics["topicC"] = TopicConfig{Class: "WorkerC"}
+
+	q.queue.Poll(context.Background())
+
+	retry := JobOptions{Retry: &BoolOrInt{Enabled: true}}
+	q.assert.Equal([]Job{
+		{Queue: "critical", Class: "WorkerA", Args: `{"foo":"bar"}`, JobOptions: retry},
+		{Queue: "low", Class: "WorkerB", Args: `{"bar":"baz"}`, JobOptions: noRetry},
+		{Queue: "background", Class: "WorkerC", Args: `{"key":"val"}`, JobOptions: retry},
+	}, q.workerClient.Jobs)
+}
+
+func (q *QueueTestSuite) TestQueue_JobOptions() {
+	message1 := MockMessage(`{"foo":"bar"}`, "topicA")
+	message2 := MockMessage(`{"bar":"baz"}`, "topicB")
+
+	q.sqsClient.Fetchable = []Message{message1, message2}
+
+	// global options apply to every topic unless the topic overrides them
+	noDead := false
+	q.queue.JobOptions = JobOptions{
+		Retry: &BoolOrInt{Enabled: true, Count: 5},
+		Dead:  &noDead,
+		In:    time.Minute,
+	}
+
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+	q.queue.Topics["topicB"] = TopicConfig{
+		Class: "WorkerB",
+		JobOptions: JobOptions{
+			Retry:     &BoolOrInt{Enabled: true, Count: 1},
+			Backtrace: &BoolOrInt{Enabled: true},
+		},
+	}
+
+	q.queue.Poll(context.Background())
+
+	q.assert.Len(q.workerClient.Jobs, 2)
+
+	jobA := q.workerClient.Jobs[0]
+	q.assert.Equal(5, jobA.Retry.Count)
+	q.assert.False(*jobA.Dead)
+	q.assert.Nil(jobA.Backtrace)
+	q.assert.Equal(time.Minute, jobA.In)
+
+	jobB := q.workerClient.Jobs[1]
+	q.assert.Equal(1, jobB.Retry.Count)
+	q.assert.False(*jobB.Dead)
+	q.assert.True(jobB.Backtrace.Enabled)
+	q.assert.Equal(time.Minute, jobB.In)
+}
+
 func (q *QueueTestSuite) TestQueue_NoTopic() {
 	// make some messages
 	message1 := MockMessage(`{"foo":"bar"}`, "topicA")
@@ -85,10 +158,10 @@ func (q *QueueTestSuite) TestQueue_NoTopic() {
 
 	// make some topics
 	// note: there is no topicB
-	q.queue.Topics["topicA"] = "WorkerA"
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
 
 	// do the work
-	q.queue.Poll()
+	q.queue.Poll(context.Background())
 
 	// The workers should be enqueued
 	// note: the topic B message is not enqueued
@@ -116,11 +189,11 @@ func (q *QueueTestSuite) TestQueue_UnparseableBody() {
 	q.sqsClient.Fetchable = []Message{message1, badMessage, message2}
 
 	// make some topics
-	q.queue.Topics["topicA"] = "WorkerA"
-	q.queue.Topics["topicB"] = "WorkerB"
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+	q.queue.Topics["topicB"] = TopicConfig{Class: "WorkerB"}
 
 	// do the work
-	q.queue.Poll()
+	q.queue.Poll(context.Background())
 
 	// The workers should be enqueued
 	// note: the unparseable worker is not enqueued
@@ -153,10 +226,10 @@ func (q *QueueTestSuite) TestQueue_ComplexBody() {
 	q.sqsClient.Fetchable = []Message{message}
 
 	// make a some topics
-	q.queue.Topics["topicA"] = "WorkerA"
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
 
 	// do the work
-	q.queue.Poll()
+	q.queue.Poll(context.Background())
 
 	// The worker should be enqueued
 	q.assert.Contains(q.workerClient.Enqueued, []string{"WorkerA", `{"foo":"bar"}`})
@@ -173,30 +246,489 @@ func (q *QueueTestSuite) TestQueue_EnqueueError() {
 	q.sqsClient.Fetchable = []Message{message1}
 
 	// make a topic
-	q.queue.Topics["topicA"] = "WorkerA"
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
 
 	// set the worker client to error out
 	q.workerClient.EnqueueError = errors.New("oops")
 
 	// do the work
-	q.queue.Poll()
+	q.queue.Poll(context.Background())
 
 	// nothing should be deleted
 	q.assert.Empty(q.sqsClient.Deleted)
 }
 
-func (q *QueueTestSuite) TestQueue_Semaphore() {
-	q.queue.Sem = new(sync.WaitGroup)
-	q.queue.Semaphore().Add(1)
-	q.queue.Poll()
+func (q *QueueTestSuite) TestQueue_EnqueueErrorReleases() {
+	message1 := MockMessage(`{"foo":"bar"}`, "topicA")
+	message1.ReceiveCount = 3
+	message2 := MockMessage(`{"bar":"baz"}`, "topicA")
+	message2.ReceiveCount = 20
+
+	q.sqsClient.Fetchable = []Message{message1, message2}
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+	q.queue.SQS = SQSConfig{BackoffBase: 10, BackoffMax: 300}
+	q.workerClient.EnqueueError = errors.New("oops")
+
+	q.queue.Poll(context.Background())
+
+	// failed messages are released with a backoff based on their receive count
+	changes := q.sqsClient.VisibilityChanges()
+	q.assert.Len(changes, 2)
+
+	q.assert.Equal(message1, changes[0].Message)
+	q.assert.GreaterOrEqual(changes[0].Timeout, int64(20))
+	q.assert.LessOrEqual(changes[0].Timeout, int64(40))
+
+	q.assert.Equal(message2, changes[1].Message)
+	q.assert.GreaterOrEqual(changes[1].Timeout, int64(150))
+	q.assert.LessOrEqual(changes[1].Timeout, int64(300))
+}
+
+func (q *QueueTestSuite) TestQueue_BatchDelete() {
+	message1 := MockMessage(`{"foo":"bar"}`, "topicA")
+	message2 := MockMessage(`{"bar":"baz"}`, "topicA")
+	message3 := MockMessage(`{"key":"val"}`, "topicA")
+
+	q.sqsClient.Fetchable = []Message{message1, message2, message3}
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+
+	q.queue.Poll(context.Background())
+
+	// all the messages are deleted in a single call
+	q.assert.Equal(1, q.sqsClient.DeleteCalls)
+	q.assert.Equal([]Message{message1, message2, message3}, q.sqsClient.Deleted)
+}
+
+func (q *QueueTestSuite) TestQueue_BatchDeleteFailures() {
+	message1 := MockMessage(`{"foo":"bar"}`, "topicA")
+	message2 := MockMessage(`{"bar":"baz"}`, "topicA")
+	message3 := MockMessage(`{"key":"val"}`, "topicA")
+
+	q.sqsClient.Fetchable = []Message{message1, message2, message3}
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+
+	// message2 fails once, message3 always fails
+	q.sqsClient.DeleteFailures = map[string]int{
+		message2.Body: 1,
+		message3.Body: 100,
+	}
+
+	q.queue.Poll(context.Background())
+
+	// only the failed messages are retried, and only once
+	q.assert.Equal(deleteAttempts, q.sqsClient.DeleteCalls)
+	q.assert.Equal([]Message{message1, message2}, q.sqsClient.Deleted)
+	q.assert.Equal(100-(deleteAttempts), q.sqsClient.DeleteFailures[message3.Body])
+}
+
+func (q *QueueTestSuite) TestQueue_FailurePolicies() {
+	good := MockMessage(`{"foo":"bar"}`, "topicA")
+	unknown := MockMessage(`{"bar":"baz"}`, "topicB")
+	noTopic := Message{Body: `{"Message":"{}"}`}
+	invalid := Message{Body: `thisain'tjson`}
+
+	q.sqsClient.Fetchable = []Message{good, unknown, noTopic, invalid}
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+
+	deadLetter := new(MockSQSClient)
+	q.queue.DeadLetter = deadLetter
+	q.queue.Failures = FailureConfig{
+		DeadLetterQueue: "dlq",
+		InvalidBody:     PolicyDeadLetter,
+		UnknownTopic:    PolicyLeave,
+	}
+
+	q.queue.Poll(context.Background())
+
+	// missing topics default to being deleted, invalid bodies are deleted once
+	// they're forwarded, and unknown topics are left alone
+	q.assert.Equal([]Message{good, noTopic, invalid}, q.sqsClient.Deleted)
+	q.assert.Empty(q.sqsClient.VisibilityChanges())
+
+	q.assert.Len(deadLetter.Sent, 1)
+	q.assert.Equal(invalid.Body, deadLetter.Sent[0].Body)
+	q.assert.Equal("invalid_body", deadLetter.Sent[0].Attributes["ScoutFailure"])
+	q.assert.Contains(deadLetter.Sent[0].Attributes["ScoutError"], "Message body could not be parsed")
+}
+
+func (q *QueueTestSuite) TestQueue_EmptyTopicARN() {
+	empty := MockMessage(`{"id":1}`, "")
+	q.sqsClient.Fetchable = []Message{empty}
+
+	deadLetter := new(MockSQSClient)
+	q.queue.DeadLetter = deadLetter
+	q.queue.Failures = FailureConfig{DeadLetterQueue: "dlq", MissingTopicARN: PolicyDeadLetter}
+
+	q.queue.Poll(context.Background())
+
+	// an empty topic ARN is missing, not a raw message without a route
+	q.assert.Len(deadLetter.Sent, 1)
+	q.assert.Equal("missing_topic_arn", deadLetter.Sent[0].Attributes["ScoutFailure"])
+	q.assert.Equal("Message has an empty topic ARN", deadLetter.Sent[0].Attributes["ScoutError"])
+}
+
+func (q *QueueTestSuite) TestQueue_DeadLetterError() {
+	invalid := Message{Body: `thisain'tjson`}
+	q.sqsClient.Fetchable = []Message{invalid}
+
+	q.queue.DeadLetter = &MockSQSClient{SendError: errors.New("oops")}
+	q.queue.Failures = FailureConfig{DeadLetterQueue: "dlq", InvalidBody: PolicyDeadLetter}
+
+	q.queue.Poll(context.Background())
+
+	// if it can't be forwarded, it's kept and retried
+	q.assert.Empty(q.sqsClient.Deleted)
+	q.assert.Len(q.sqsClient.VisibilityChanges(), 1)
+}
+
+func (q *QueueTestSuite) TestQueue_Raw() {
+	q.queue.Format = FormatRaw
+	q.queue.RouteAttribute = "event_type"
+	q.queue.Topics["loan.funded"] = TopicConfig{Class: "FundedWorker"}
+	q.queue.Topics["loan.paid"] = TopicConfig{Class: "PaidWorker"}
+
+	funded := Message{Body: `{"id":1}`, Attributes: map[string]string{"event_type": "loan.funded"}}
+	paid := Message{Body: `{"id":2}`, Attributes: map[string]string{"event_type": "loan.paid"}}
+	unknown := Message{Body: `{"id":3}`, Attributes: map[string]string{"event_type": "loan.lost"}}
+	missing := Message{Body: `{"id":4}`}
+	invalid := Message{Body: `thisain'tjson`, Attributes: map[string]string{"event_type": "loan.paid"}}
+
+	q.sqsClient.Fetchable = []Message{funded, paid, unknown, missing, invalid}
+	q.queue.Failures = FailureConfig{MissingRoute: PolicyLeave}
+
+	q.queue.Poll(context.Background())
+
+	// the whole body is the args
+	q.assert.Equal([][]string{
+		{"FundedWorker", `{"id":1}`},
+		{"PaidWorker", `{"id":2}`},
+	}, q.workerClient.Enqueued)
+
+	// messages without the attribute are left per the policy
+	q.assert.Equal([]Message{funded, paid, unknown, invalid}, q.sqsClient.Deleted)
+}
+
+func (q *QueueTestSuite) TestQueue_RawWorker() {
+	q.queue.Format = FormatRaw
+	q.queue.RouteAttribute = "event_type"
+	q.queue.Topics["loan.funded"] = TopicConfig{Class: "FundedWorker"}
+	q.queue.Worker = &TopicConfig{Class: "EverythingWorker", Queue: "low"}
+
+	funded := Message{Body: `{"id":1}`, Attributes: map[string]string{"event_type": "loan.funded"}}
+	other := Message{Body: `{"id":2}`}
+
+	q.sqsClient.Fetchable = []Message{funded, other}
+
+	q.queue.Poll(context.Background())
+
+	// messages without the attribute go to the static worker
+	q.assert.Equal([][]string{
+		{"FundedWorker", `{"id":1}`},
+		{"EverythingWorker", `{"id":2}`},
+	}, q.workerClient.Enqueued)
+	q.assert.Equal("low", q.workerClient.Jobs[1].Queue)
+}
+
+func (q *QueueTestSuite) TestQueue_Routes() {
+	q.queue.Topics["loans"] = TopicConfig{Class: "LoanWorker"}
+	q.queue.Routes = []RouteConfig{
+		{
+			Topic:      "loans",
+			Attributes: map[string]string{"event_type": "loan.funded"},
+			Workers:    []TopicConfig{{Class: "FundedWorker"}, {Class: "AuditWorker", Queue: "low"}},
+		},
+		{
+			Fields:  map[string]string{"loan.state": "CA", "amount": "500"},
+			Workers: []TopicConfig{{Class: "CaliforniaWorker"}, {Class: "AuditWorker", Queue: "low"}},
+		},
+	}
+
+	funded := MockAttributedMessage(`{"loan":{"state":"CA"},"amount":500}`, "arn:aws:sns:us-east-1:1:loans",
+		map[string]string{"event_type": "loan.funded"})
+	california := MockMessage(`{"loan":{"state":"CA"},"amount":500}`, "arn:aws:sns:us-east-1:1:loans")
+	other := MockAttributedMessage(`{"loan":{"state":"NY"}}`, "arn:aws:sns:us-east-1:1:loans",
+		map[string]string{"event_type": "loan.paid"})
+	unknown := MockMessage(`{"loan":{"state":"NY"}}`, "arn:aws:sns:us-east-1:1:payments")
+
+	q.sqsClient.Fetchable = []Message{funded, california, other, unknown}
+
+	q.queue.Poll(context.Background())
+
+	// every matching route is used, but the same worker is only enqueued
+	// once, and messages that don't match any route use the topics
+	q.assert.Equal([][]string{
+		{"FundedWorker", `{"loan":{"state":"CA"},"amount":500}`},
+		{"AuditWorker", `{"loan":{"state":"CA"},"amount":500}`},
+		{"CaliforniaWorker", `{"loan":{"state":"CA"},"amount":500}`},
+		{"CaliforniaWorker", `{"loan":{"state":"CA"},"amount":500}`},
+		{"AuditWorker", `{"loan":{"state":"CA"},"amount":500}`},
+		{"LoanWorker", `{"loan":{"state":"NY"}}`},
+	}, q.workerClient.Enqueued)
+	q.assert.Equal("low", q.workerClient.Jobs[1].Queue)
+
+	q.assert.Equal([]Message{funded, california, other, unknown}, q.sqsClient.Deleted)
+}
+
+func (q *QueueTestSuite) TestQueue_TopicARNs() {
+	q.queue.Topics["orders"] = TopicConfig{Class: "OrderWorker"}
+	q.queue.Topics["arn:aws:sns:eu-west-1:222:orders"] = TopicConfig{Class: "EuropeOrderWorker"}
+	q.queue.Topics["arn:aws:sns:*:111:*"] = TopicConfig{Class: "AccountWorker"}
+	q.queue.Topics["arn:aws:sns:*:111:refunds"] = TopicConfig{Class: "RefundWorker"}
+	q.queue.Topics["pay*"] = TopicConfig{Class: "PaymentWorker"}
+
+	q.sqsClient.Fetchable = []Message{
+		MockMessage(`{"id":1}`, "arn:aws:sns:us-east-1:333:orders"),
+		MockMessage(`{"id":2}`, "arn:aws:sns:eu-west-1:222:orders"),
+		MockMessage(`{"id":3}`, "arn:aws:sns:us-east-1:111:payments"),
+		MockMessage(`{"id":4}`, "arn:aws:sns:us-east-1:111:refunds"),
+		MockMessage(`{"id":5}`, "arn:aws:sns:us-east-1:111:orders"),
+	}
+
+	q.queue.Poll(context.Background())
+
+	// the most specific key wins: an exact ARN, then an exact name, then an
+	// ARN pattern, then a name pattern, with the fewest wildcards winning
+	// between patterns
+	q.assert.Equal([][]string{
+		{"OrderWorker", `{"id":1}`},
+		{"EuropeOrderWorker", `{"id":2}`},
+		{"AccountWorker", `{"id":3}`},
+		{"RefundWorker", `{"id":4}`},
+		{"OrderWorker", `{"id":5}`},
+	}, q.workerClient.Enqueued)
+}
+
+func (q *QueueTestSuite) TestQueue_TopicNamePatterns() {
+	q.queue.Topics["orders-*"] = TopicConfig{Class: "OrderWorker"}
+	q.queue.Topics["orders-eu"] = TopicConfig{Class: "EuropeOrderWorker"}
+	q.queue.Topics["*:111:*"] = TopicConfig{Class: "AccountWorker"}
+
+	q.sqsClient.Fetchable = []Message{
+		MockMessage(`{"id":1}`, "arn:aws:sns:us-east-1:111:orders-us"),
+		MockMessage(`{"id":2}`, "arn:aws:sns:eu-west-1:111:orders-eu"),
+		MockMessage(`{"id":3}`, "arn:aws:sns:us-east-1:111:payments"),
+	}
+	q.queue.Failures = FailureConfig{UnknownTopic: PolicyLeave}
+
+	q.queue.Poll(context.Background())
+
+	// patterns that don't start with arn: only match the topic name
+	q.assert.Equal([][]string{
+		{"OrderWorker", `{"id":1}`},
+		{"EuropeOrderWorker", `{"id":2}`},
+	}, q.workerClient.Enqueued)
+}
+
+func (q *QueueTestSuite) TestQueue_RoutesTopicPattern() {
+	q.queue.Routes = []RouteConfig{
+		{Topic: "arn:aws:sns:us-*:111:*", Workers: []TopicConfig{{Class: "USWorker"}}},
+	}
+
+	q.sqsClient.Fetchable = []Message{
+		MockMessage(`{"id":1}`, "arn:aws:sns:us-east-1:111:orders"),
+		MockMessage(`{"id":2}`, "arn:aws:sns:eu-west-1:111:orders"),
+	}
+
+	q.queue.Poll(context.Background())
+
+	q.assert.Equal([][]string{{"USWorker", `{"id":1}`}}, q.workerClient.Enqueued)
+}
+
+func (q *QueueTestSuite) TestQueue_RoutesRaw() {
+	q.queue.Format = FormatRaw
+	q.queue.Routes = []RouteConfig{
+		{
+			Attributes: map[string]string{"source": "web"},
+			Fields:     map[string]string{"items.0.sku": "abc"},
+			Workers:    []TopicConfig{{Class: "WebWorker"}},
+		},
+	}
+
+	web := Message{Body: `{"items":[{"sku":"abc"}]}`, Attributes: map[string]string{"source": "web"}}
+	api := Message{Body: `{"items":[{"sku":"abc"}]}`, Attributes: map[string]string{"source": "api"}}
+
+	q.sqsClient.Fetchable = []Message{web, api}
+	q.queue.Failures = FailureConfig{MissingRoute: PolicyLeave}
+
+	q.queue.Poll(context.Background())
+
+	// raw messages match on their sqs attributes and body
+	q.assert.Equal([][]string{{"WebWorker", `{"items":[{"sku":"abc"}]}`}}, q.workerClient.Enqueued)
+	q.assert.Equal([]Message{web}, q.sqsClient.Deleted)
+}
+
+func (q *QueueTestSuite) TestQueue_Metrics() {
+	q.queue.Name = "metrics_test"
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+
+	fetched := counterDelta(metrics.MessagesFetched, "metrics_test")
+	enqueued := counterDelta(metrics.MessagesEnqueued, "metrics_test", "topicA", "WorkerA")
+	deletedA := counterDelta(metrics.MessagesDeleted, "metrics_test", "topicA")
+	deletedUnknown := counterDelta(metrics.MessagesDeleted, "metrics_test", "unknown")
+	unknown := counterDelta(metrics.MessagesFailed, "metrics_test", "unknown", "", "unknown_topic")
+	invalid := counterDelta(metrics.MessagesFailed, "metrics_test", "unknown", "", "invalid_body")
+	unknownTopics := counterDelta(metrics.UnknownTopics, "metrics_test", "unknown")
+	parseErrors := counterDelta(metrics.ParseErrors, "metrics_test", "invalid_body")
+	pushFailed := counterDelta(metrics.MessagesFailed, "metrics_test", "topicA", "WorkerA", "enqueue")
+
+	q.sqsClient.Fetchable = []Message{
+		MockMessage(`{"id":1}`, "topicA"),
+		MockMessage(`{"id":2}`, "topicB"),
+		{Body: `thisain'tjson`},
+	}
+
+	q.queue.Poll(context.Background())
+
+	q.assert.Equal(float64(3), fetched())
+	q.assert.Equal(float64(1), enqueued())
+	q.assert.Equal(float64(1), deletedA())
+	q.assert.Equal(float64(2), deletedUnknown())
+	q.assert.Equal(float64(1), unknown())
+	q.assert.Equal(float64(1), invalid())
+	q.assert.Equal(float64(1), unknownTopics())
+	q.assert.Equal(float64(1), parseErrors())
+	q.assert.Equal(float64(0), testutil.ToFloat64(metrics.PollsInFlight.WithLabelValues("metrics_test")))
+
+	// failed pushes are counted against their worker
+	q.workerClient.EnqueueError = errors.New("redis is down")
+	q.sqsClient.Fetchable = []Message{MockMessage(`{"id":3}`, "topicA")}
+	q.queue.Poll(context.Background())
+
+	q.assert.Equal(float64(1), pushFailed())
+}
+
+func (q *QueueTestSuite) TestQueue_MetricsTopicLabels() {
+	q.queue.Name = "labels_test"
+	q.queue.Topics["orders-*"] = TopicConfig{Class: "OrderWorker"}
+	q.queue.Routes = []RouteConfig{
+		{Attributes: map[string]string{"kind": "refund"}, Workers: []TopicConfig{{Class: "RefundWorker"}}},
+	}
+
+	pattern := counterDelta(metrics.MessagesEnqueued, "labels_test", "orders-*", "OrderWorker")
+	route := counterDelta(metrics.MessagesEnqueued, "labels_test", "routes[0]", "RefundWorker")
+
+	q.sqsClient.Fetchable = []Message{
+		MockMessage(`{"id":1}`, "orders-us"),
+		MockAttributedMessage(`{"id":2}`, "payments", map[string]string{"kind": "refund"}),
+	}
+
+	q.queue.Poll(context.Background())
+
+	// messages are counted under the key or route they matched, not the
+	// topic they came from, so they can't make up labels of their own
+	q.assert.Equal(float64(1), pattern())
+	q.assert.Equal(float64(1), route())
+}
+
+func (q *QueueTestSuite) TestQueue_PollResult() {
+	q.queue.SQS.MaxNumberOfMessages = 2
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+
+	q.assert.Equal(PollEmpty, q.queue.Poll(context.Background()))
+
+	q.sqsClient.Fetchable = []Message{MockMessage(`{"id":1}`, "topicA")}
+	q.assert.Equal(PollPartial, q.queue.Poll(context.Background()))
+
+	q.sqsClient.Fetchable = []Message{MockMessage(`{"id":1}`, "topicA"), MockMessage(`{"id":2}`, "topicA")}
+	q.assert.Equal(PollFull, q.queue.Poll(context.Background()))
+
+	// errors back off like empty batches
+	q.sqsClient.FetchError = errors.New("throttled")
+	q.assert.Equal(PollEmpty, q.queue.Poll(context.Background()))
+}
+
+func (q *QueueTestSuite) TestQueue_Pool() {
+	q.queue.Pool = NewWorkerPool(3)
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+
+	var messages []Message
+	for i := 0; i < 20; i++ {
+		messages = append(messages, MockMessage(fmt.Sprintf(`{"id":%d}`, i), "topicA"))
+	}
+	messages[5] = MockMessage(`{"id":5}`, "topicB")
+
+	q.sqsClient.Fetchable = messages
+	q.queue.Poll(context.Background())
+
+	// every message is enqueued, in any order, but they're deleted in order
+	q.assert.Len(q.workerClient.Enqueued, 19)
+	q.assert.Equal(messages, q.sqsClient.Deleted)
+}
+
+func (q *QueueTestSuite) TestQueue_Cancelled() {
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+
+	message := MockMessage(`{"id":1}`, "topicA")
+	q.sqsClient.Fetchable = []Message{message}
+
+	// once the poll is cancelled, messages are released instead of enqueued
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.queue.Poll(ctx)
+
+	q.assert.Empty(q.workerClient.Enqueued)
+	q.assert.Empty(q.sqsClient.Deleted)
+	q.assert.Equal([]VisibilityChange{{message, 0}}, q.sqsClient.VisibilityChanges())
+}
+
+func (q *QueueTestSuite) TestQueue_CancelledPush() {
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+	q.queue.SQS = SQSConfig{BackoffBase: 30, BackoffMax: 30}
+
+	message := MockMessage(`{"id":1}`, "topicA")
+
+	// a push that fails because the poll was cancelled is released right
+	// away rather than backed off
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	topic, deleted := q.queue.processMessage(ctx, message, nil)
+	q.assert.Equal("topicA", topic)
+	q.assert.False(deleted)
 
-	// Calling Done() on a waitgroup that's at 0 will segfault
-	q.assert.Panics(func() {
-		q.queue.Semaphore().Done()
-	})
+	q.assert.Empty(q.workerClient.Enqueued)
+	q.assert.Equal([]VisibilityChange{{message, 0}}, q.sqsClient.VisibilityChanges())
+}
+
+func (q *QueueTestSuite) TestQueue_DryRun() {
+	q.queue.DryRun = true
+	q.queue.Topics["topicA"] = TopicConfig{Class: "WorkerA"}
+
+	routed := MockMessage(`{"id":1}`, "topicA")
+	unknown := MockMessage(`{"id":2}`, "topicB")
+	q.sqsClient.Fetchable = []Message{routed, unknown}
+	q.queue.Poll(context.Background())
+
+	// nothing is enqueued or deleted, and everything is released right away
+	q.assert.Empty(q.workerClient.Enqueued)
+	q.assert.Empty(q.sqsClient.Deleted)
+	q.assert.Equal(0, q.sqsClient.DeleteCalls)
+	q.assert.ElementsMatch([]VisibilityChange{{routed, 0}, {unknown, 0}}, q.sqsClient.VisibilityChanges())
 }
 
 func TestTopicName(t *testing.T) {
 	// from http://docs.aws.amazon.com/sns/latest/dg/SendMessageToSQS.html
 	require.Equal(t, topicName("arn:aws:sns:us-west-2:123456789012:MyTopic"), "MyTopic")
 }
+
+func TestBackoff(t *testing.T) {
+	// doubles with every receive, jittered down by up to half
+	for receives, max := range map[int64]int64{0: 2, 1: 2, 2: 4, 3: 8, 4: 16, 5: 30, 100: 30} {
+		for i := 0; i < 100; i++ {
+			delay := backoff(receives, 2, 30)
+			require.GreaterOrEqual(t, delay, max/2)
+			require.LessOrEqual(t, delay, max)
+		}
+	}
+
+	// tiny delays aren't jittered
+	require.Equal(t, int64(1), backoff(1, 1, 30))
+	require.Equal(t, int64(0), backoff(1, 0, 30))
+}
+
+func TestDeadLetterQueueConfig(t *testing.T) {
+	require.Equal(t, QueueConfig{Name: "dlq"}, deadLetterQueueConfig("dlq"))
+	require.Equal(t,
+		QueueConfig{URL: "https://sqs.us-east-1.amazonaws.com/123/dlq"},
+		deadLetterQueueConfig("https://sqs.us-east-1.amazonaws.com/123/dlq"),
+	)
+}
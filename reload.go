@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reloader is a queue whose routing can be swapped out while it's running
+type Reloader interface {
+	// Reload takes the routing for the queue from the new config
+	Reload(config *Config) error
+}
+
+// watchReloads reloads the config from the file every time we get a SIGHUP,
+// until the context is done
+func watchReloads(ctx context.Context, file string, config *Config, queues []Queue) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloads:
+			log.Infof("Got HUP, reloading config from %s", file)
+
+			reloaded, err := reloadConfig(file, config, queues)
+			if errs, ok := err.(ValidationErrors); ok {
+				for _, e := range errs {
+					log.Error("Invalid config: ", e.Error())
+				}
+				log.Error("Kept the old config")
+				continue
+			} else if err != nil {
+				log.Error("Couldn't reload config, kept the old one: ", err.Error())
+				continue
+			}
+
+			config = reloaded
+			log.Info("Reloaded config")
+		}
+	}
+}
+
+// reloadConfig loads and validates the config in the file, and swaps the
+// routing of every queue over to it. If anything is wrong with it, nothing
+// is swapped and the error is returned. Only the routing can be reloaded,
+// anything else that changed is logged and needs a restart
+func reloadConfig(file string, current *Config, queues []Queue) (*Config, error) {
+	config, err := LoadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, queueConfig := range config.QueueConfigs() {
+		names[queueConfig.DisplayName()] = true
+	}
+
+	for _, queueConfig := range current.QueueConfigs() {
+		if !names[queueConfig.DisplayName()] {
+			return nil, fmt.Errorf("queue %s was removed, which needs a restart", queueConfig.DisplayName())
+		}
+	}
+
+	if !reflect.DeepEqual(withoutRouting(current), withoutRouting(config)) {
+		log.Warn("Only topics, routes, workers, sidekiq queues and job options are reloaded. Restart scout for the rest of the changes")
+	}
+
+	for _, queue := range queues {
+		if reloader, ok := queue.(Reloader); ok {
+			if err := reloader.Reload(config); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// withoutRouting returns a copy of the config with everything that can be
+// reloaded cleared, to check if anything else changed
+func withoutRouting(config *Config) Config {
+	stripped := *config
+	stripped.Redis.Queue = ""
+	stripped.Redis.JobOptions = JobOptions{}
+	stripped.Queue = queueWithoutRouting(config.Queue)
+
+	stripped.Queues = make([]QueueConfig, len(config.Queues))
+	for i, queueConfig := range config.Queues {
+		stripped.Queues[i] = queueWithoutRouting(queueConfig)
+	}
+
+	return stripped
+}
+
+func queueWithoutRouting(queueConfig QueueConfig) QueueConfig {
+	queueConfig.Topics = nil
+	queueConfig.SidekiqQueue = ""
+	queueConfig.RouteAttribute = ""
+	queueConfig.Worker = nil
+	queueConfig.Routes = nil
+
+	return queueConfig
+}
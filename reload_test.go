@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// reloadQueue creates a queue with the routing from the config
+func reloadQueue(t *testing.T, config *Config) *queue {
+	q := &queue{Name: "myapp_queue"}
+	require.NoError(t, q.Reload(config))
+	return q
+}
+
+func TestReloadConfig(t *testing.T) {
+	file := writeConfig(t, validConfig)
+	current, err := LoadConfig(file)
+	require.NoError(t, err)
+	q := reloadQueue(t, current)
+
+	updated := strings.Replace(validConfig, `bar_topic: "BazWorker"`, `new_topic: "NewWorker"`, 1)
+	updated = strings.Replace(updated, `queue: "background"`, `queue: "critical"`, 1)
+	require.NoError(t, os.WriteFile(file, []byte(updated), 0600))
+
+	config, err := reloadConfig(file, current, []Queue{q})
+	require.NoError(t, err)
+	require.Equal(t, "critical", config.Redis.Queue)
+
+	require.Equal(t, "critical", q.SidekiqQueue)
+	require.Equal(t, map[string]TopicConfig{
+		"foo_topic": {Class: "FooWorker"},
+		"new_topic": {Class: "NewWorker"},
+	}, q.Topics)
+}
+
+func TestReloadConfig_Invalid(t *testing.T) {
+	file := writeConfig(t, validConfig)
+	current, err := LoadConfig(file)
+	require.NoError(t, err)
+	q := reloadQueue(t, current)
+
+	// invalid configs are reported, and the old routing is kept
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(validConfig, `foo_topic: "FooWorker"`, `foo_topic: ""`, 1)), 0600))
+	_, err = reloadConfig(file, current, []Queue{q})
+	require.IsType(t, ValidationErrors{}, err)
+	require.Equal(t, "FooWorker", q.Topics["foo_topic"].Class)
+
+	// so are queues going away
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(validConfig, "myapp_queue", "other_queue", 1)), 0600))
+	_, err = reloadConfig(file, current, []Queue{q})
+	require.EqualError(t, err, "queue myapp_queue was removed, which needs a restart")
+	require.Equal(t, "FooWorker", q.Topics["foo_topic"].Class)
+}
+
+func TestWatchReloads(t *testing.T) {
+	file := writeConfig(t, validConfig)
+	current, err := LoadConfig(file)
+	require.NoError(t, err)
+	q := reloadQueue(t, current)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchReloads(ctx, file, current, []Queue{q})
+
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(validConfig, `"FooWorker"`, `"ReloadedWorker"`, 1)), 0600))
+	reloads <- syscall.SIGHUP
+
+	require.Eventually(t, func() bool {
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		return q.Topics["foo_topic"].Class == "ReloadedWorker"
+	}, time.Second, time.Millisecond)
+}
+
+func TestReload_DuringVerify(t *testing.T) {
+	file := writeConfig(t, validConfig)
+	current, err := LoadConfig(file)
+	require.NoError(t, err)
+	q := reloadQueue(t, current)
+
+	fetching, release := make(chan bool), make(chan bool)
+	q.Verifier = &SignatureVerifier{
+		CertHosts: DefaultCertHosts,
+		Certs: NewCertCache(func(url string) ([]byte, error) {
+			fetching <- true
+			<-release
+			return []byte(fixtureCert), nil
+		}),
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := q.enqueueMessage(context.Background(), Message{Body: fixtureNotification}, log.StandardLogger())
+		done <- err
+	}()
+
+	// the cert is fetched without holding the routing, so reloading doesn't
+	// wait on it
+	<-fetching
+	reloaded := make(chan error)
+	go func() { reloaded <- q.Reload(current) }()
+
+	select {
+	case err := <-reloaded:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("reload waited on the cert fetch")
+	}
+
+	close(release)
+	require.EqualError(t, <-done, "No worker for topic: loans")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// maxReplayLine is the longest line replay reads. It's well over the most
+// SQS allows in a message
+const maxReplayLine = 1 << 20
+
+// replaySummary counts what happened to each line that was replayed
+type replaySummary struct {
+	Enqueued   int
+	Unroutable int
+	Failed     int
+}
+
+func (s replaySummary) String() string {
+	return fmt.Sprintf("%d enqueued, %d unroutable, %d failed", s.Enqueued, s.Unroutable, s.Failed)
+}
+
+// runReplay enqueues every message in a file with the routing of one of the
+// queues in the config, and prints how it went. A signal stops it after the
+// line it's on, and it prints how far it got
+func runReplay(ctx *cli.Context) error {
+	configFile := ctx.String("config")
+	if configFile == "" {
+		configFile = ctx.GlobalString("config")
+	}
+
+	if configFile == "" || ctx.NArg() != 1 {
+		return cli.NewExitError("Usage: scout replay --config FILE [--queue NAME] MESSAGES. Run `scout replay --help` for more information", 1)
+	}
+
+	config, err := LoadConfig(configFile)
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			log.Error("Invalid config: ", e.Error())
+		}
+		return cli.NewExitError("Config file is invalid. Run `scout validate` for more information", 1)
+	} else if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to parse config file: %s", err.Error()), 1)
+	}
+
+	queueConfig, err := replayQueueConfig(config, ctx.String("queue"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	workerClient, err := NewRedisWorkerClient(config.Redis)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Initialization error: %s", err.Error()), 1)
+	}
+
+	q, err := newReplayQueue(config, queueConfig, workerClient)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Initialization error: %s", err.Error()), 1)
+	}
+
+	file, err := os.Open(ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Couldn't open messages: %s", err.Error()), 1)
+	}
+	defer file.Close()
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), stopSignals...)
+	defer stop()
+
+	summary, err := Replay(signalCtx, q, file)
+	fmt.Fprintln(ctx.App.Writer, summary)
+	return replayExit(signalCtx, summary, err)
+}
+
+// replayExit works out how replay exits from what Replay returned. A signal
+// only counts if it stopped Replay early. One that came in on the last line
+// didn't stop anything, so the file was replayed like normal
+func replayExit(signalCtx context.Context, summary replaySummary, err error) error {
+	if err != nil && signalCtx.Err() != nil {
+		return cli.NewExitError(fmt.Sprintf("Stopped by a signal, %s", err.Error()), 1)
+	} else if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Couldn't read messages: %s", err.Error()), 1)
+	}
+
+	if summary.Failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d message(s) failed to enqueue and can be replayed again", summary.Failed), 1)
+	}
+
+	return nil
+}
+
+// replayQueueConfig finds the queue to take the routing from. The name can
+// be left out if there's only one
+func replayQueueConfig(config *Config, name string) (QueueConfig, error) {
+	queueConfigs := config.QueueConfigs()
+	if name == "" {
+		if len(queueConfigs) != 1 {
+			return QueueConfig{}, errors.New("The config has more than one queue, pick one with --queue")
+		}
+
+		return queueConfigs[0], nil
+	}
+
+	for _, queueConfig := range queueConfigs {
+		if queueConfig.DisplayName() == name {
+			return queueConfig, nil
+		}
+	}
+
+	return QueueConfig{}, fmt.Errorf("No queue named %s in the config", name)
+}
+
+// newReplayQueue creates a queue that only routes and enqueues, without an
+// SQS client, since replayed messages don't come from SQS
+func newReplayQueue(config *Config, queueConfig QueueConfig, workerClient WorkerClient) (*queue, error) {
+	q := &queue{
+		Name:         queueConfig.DisplayName(),
+		WorkerClient: workerClient,
+		Format:       queueConfig.Format,
+		Verifier:     NewSignatureVerifier(queueConfig.Signatures),
+	}
+
+	if err := q.setRouting(config, queueConfig); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Replay enqueues the message on each line, which is an SNS envelope or a
+// raw body depending on the queue's format. Blank lines are skipped. Lines
+// that can never be enqueued are unroutable, and ones that should be tried
+// again failed. It only returns an error if the lines couldn't be read, or
+// if ctx is done, which stops it before the next line. The line it's on is
+// still finished, so the summary covers every line before the one reported
+func Replay(ctx context.Context, q *queue, r io.Reader) (replaySummary, error) {
+	var summary replaySummary
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLine)
+
+	for line := 1; scanner.Scan(); line++ {
+		if ctx.Err() != nil {
+			return summary, fmt.Errorf("lines from %d on weren't replayed", line)
+		}
+
+		body := strings.TrimSpace(scanner.Text())
+		if body == "" {
+			continue
+		}
+
+		msg := Message{MessageID: fmt.Sprintf("line %d", line), Body: body}
+		logger := log.WithField("Line", line)
+
+		_, err := q.enqueueMessage(context.Background(), msg, logger)
+
+		var rejected *RejectedError
+		switch {
+		case err == nil:
+			summary.Enqueued++
+		case errors.As(err, &rejected):
+			logger.WithField("Failure", rejected.Class).Warn("Couldn't route message: ", err.Error())
+			summary.Unroutable++
+		default:
+			logger.Error("Couldn't enqueue message: ", err.Error())
+			summary.Failed++
+		}
+	}
+
+	return summary, scanner.Err()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	workerClient := &MockWorkerClient{EnqueuedJID: "jid"}
+	q, err := newReplayQueue(config, config.Queue, workerClient)
+	require.NoError(t, err)
+
+	lines := strings.Join([]string{
+		MockMessage(`{"id":1}`, "arn:aws:sns:us-east-1:111:foo_topic").Body,
+		"",
+		MockMessage(`{"id":2}`, "arn:aws:sns:us-east-1:111:other_topic").Body,
+		`not json`,
+		MockMessage(`{"id":3}`, "arn:aws:sns:us-east-1:111:bar_topic").Body,
+	}, "\n")
+
+	summary, err := Replay(context.Background(), q, strings.NewReader(lines))
+	require.NoError(t, err)
+	require.Equal(t, replaySummary{Enqueued: 2, Unroutable: 2}, summary)
+	require.Equal(t, [][]string{{"FooWorker", `{"id":1}`}, {"BazWorker", `{"id":3}`}}, workerClient.Enqueued)
+	require.Equal(t, "background", workerClient.Jobs[0].Queue)
+
+	// messages that fail to push can be replayed again
+	workerClient.EnqueueError = errors.New("connection refused")
+	summary, err = Replay(context.Background(), q, strings.NewReader(lines))
+	require.NoError(t, err)
+	require.Equal(t, replaySummary{Unroutable: 2, Failed: 2}, summary)
+	require.Equal(t, "0 enqueued, 2 unroutable, 2 failed", summary.String())
+}
+
+func TestReplay_Cancelled(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	workerClient := &MockWorkerClient{EnqueuedJID: "jid"}
+	q, err := newReplayQueue(config, config.Queue, workerClient)
+	require.NoError(t, err)
+
+	first := MockMessage(`{"id":1}`, "arn:aws:sns:us-east-1:111:foo_topic").Body
+	second := MockMessage(`{"id":2}`, "arn:aws:sns:us-east-1:111:foo_topic").Body
+
+	// cancel once the first line has been read, like a signal would
+	ctx, cancel := context.WithCancel(context.Background())
+	r := io.MultiReader(strings.NewReader(first+"\n"), cancelReader{cancel}, strings.NewReader(second))
+
+	// the summary says how far it got
+	summary, err := Replay(ctx, q, r)
+	require.EqualError(t, err, "lines from 2 on weren't replayed")
+	require.Equal(t, replaySummary{Enqueued: 1}, summary)
+	require.Equal(t, [][]string{{"FooWorker", `{"id":1}`}}, workerClient.Enqueued)
+}
+
+func TestReplay_CancelledOnLastLine(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	// cancel while the last line is being pushed, like a signal would
+	ctx, cancel := context.WithCancel(context.Background())
+	workerClient := &cancelWorkerClient{MockWorkerClient: &MockWorkerClient{EnqueuedJID: "jid"}, cancel: cancel}
+	q, err := newReplayQueue(config, config.Queue, workerClient)
+	require.NoError(t, err)
+
+	lines := MockMessage(`{"id":1}`, "arn:aws:sns:us-east-1:111:foo_topic").Body + "\n"
+
+	// there was nothing left to stop, so it exits like normal
+	summary, err := Replay(ctx, q, strings.NewReader(lines))
+	require.NoError(t, err)
+	require.Equal(t, replaySummary{Enqueued: 1}, summary)
+	require.Error(t, ctx.Err())
+	require.NoError(t, replayExit(ctx, summary, err))
+
+	// failed pushes still fail it
+	ctx, cancel = context.WithCancel(context.Background())
+	workerClient.cancel = cancel
+	workerClient.EnqueueError = errors.New("connection refused")
+	summary, err = Replay(ctx, q, strings.NewReader(lines))
+	require.NoError(t, err)
+	require.EqualError(t, replayExit(ctx, summary, err), "1 message(s) failed to enqueue and can be replayed again")
+
+	// lines that weren't replayed are reported
+	require.EqualError(t, replayExit(ctx, summary, errors.New("lines from 2 on weren't replayed")), "Stopped by a signal, lines from 2 on weren't replayed")
+}
+
+// cancelWorkerClient cancels a context whenever it pushes a job
+type cancelWorkerClient struct {
+	*MockWorkerClient
+	cancel context.CancelFunc
+}
+
+func (c *cancelWorkerClient) Push(ctx context.Context, job Job) (string, error) {
+	defer c.cancel()
+	return c.MockWorkerClient.Push(ctx, job)
+}
+
+// cancelReader cancels a context when it's read from
+type cancelReader struct {
+	cancel context.CancelFunc
+}
+
+func (c cancelReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return 0, io.EOF
+}
+
+func TestReplayQueueConfig(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	queueConfig, err := replayQueueConfig(config, "")
+	require.NoError(t, err)
+	require.Equal(t, "myapp_queue", queueConfig.Name)
+
+	config.Queues = []QueueConfig{{Name: "other_queue"}}
+	_, err = replayQueueConfig(config, "")
+	require.EqualError(t, err, "The config has more than one queue, pick one with --queue")
+
+	queueConfig, err = replayQueueConfig(config, "other_queue")
+	require.NoError(t, err)
+	require.Equal(t, "other_queue", queueConfig.Name)
+
+	_, err = replayQueueConfig(config, "missing")
+	require.EqualError(t, err, "No queue named missing in the config")
+}
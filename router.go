@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// envelope is everything a message can be routed on, once it's been parsed
+type envelope struct {
+	// Topic is the topic name for SNS messages, or the value of the route
+	// attribute for raw ones. It's empty if there isn't one
+	Topic string
+
+	// TopicARN is the full topic ARN for SNS messages, and empty for raw ones
+	TopicARN string
+
+	// Attributes are the SNS message attributes for SNS messages, or the
+	// SQS message attributes for raw ones
+	Attributes map[string]string
+
+	// Args is the payload, which becomes the job's args
+	Args string
+
+	// payload is Args parsed as json, for matching fields
+	payload interface{}
+	parsed  bool
+}
+
+// The topic labels in the metrics for messages that weren't sent to a worker
+// by a topic key or route. Labels only ever come from the config, so a
+// message can't make up new ones
+const (
+	topicUnknown = "unknown" // the message couldn't be parsed or routed
+	topicWorker  = "worker"  // a raw message went to the queue's worker
+)
+
+// parse parses a message into an envelope and checks its signature. It only
+// uses the parts of the queue that can't be reloaded, so it doesn't need the
+// routing lock, which matters since verifying can fetch a cert
+func (q *queue) parse(msg Message, ctx log.FieldLogger) (*envelope, error) {
+	if q.Format == FormatRaw {
+		return parseRaw(msg)
+	}
+
+	env, err := parseSNS(msg, ctx)
+	if err == nil && q.Verifier != nil {
+		err = q.Verifier.Verify(msg.Body)
+	}
+
+	return env, err
+}
+
+// route works out which topics a parsed message should be enqueued as. The
+// args for their jobs are in the envelope. Every route the message matches
+// is used. If it doesn't match any, it falls back to the topic mapping. It
+// also returns the label to count the message under, which is the topic key
+// or route that matched. It has to be called with the routing lock held
+func (q *queue) route(env *envelope) ([]TopicConfig, string, error) {
+	if q.Format == FormatRaw && q.RouteAttribute != "" {
+		env.Topic = env.Attributes[q.RouteAttribute]
+	}
+
+	if topics, label := q.matchRoutes(env); len(topics) > 0 {
+		return topics, label, nil
+	}
+
+	if q.Format == FormatRaw && env.Topic == "" {
+		if q.Worker == nil {
+			return nil, topicUnknown, reject(FailureMissingRoute, "Message has no %s attribute", q.RouteAttribute)
+		}
+
+		return []TopicConfig{*q.Worker}, topicWorker, nil
+	}
+
+	key, topic, ok := q.matchTopic(env)
+	if !ok {
+		if q.Format == FormatRaw {
+			return nil, topicUnknown, reject(FailureUnknownTopic, "No worker for %s: %s", q.RouteAttribute, env.Topic)
+		}
+
+		return nil, topicUnknown, reject(FailureUnknownTopic, "No worker for topic: %s", env.Topic)
+	}
+
+	return []TopicConfig{topic}, key, nil
+}
+
+// snsAttribute is a message attribute in an SNS envelope
+type snsAttribute struct {
+	Type  string
+	Value string
+}
+
+// parseSNS parses a message in an SNS envelope
+func parseSNS(msg Message, ctx log.FieldLogger) (*envelope, error) {
+	body := make(map[string]json.RawMessage)
+	err := json.Unmarshal([]byte(msg.Body), &body)
+	if err != nil {
+		return nil, reject(FailureInvalidBody, "Message body could not be parsed: %s", err.Error())
+	}
+
+	var topicARN string
+	err = json.Unmarshal(body["TopicArn"], &topicARN)
+	if err != nil {
+		return nil, reject(FailureMissingTopicARN, "Topic ARN could not be parsed: %s", err.Error())
+	}
+
+	if topicARN == "" {
+		return nil, reject(FailureMissingTopicARN, "Message has an empty topic ARN")
+	}
+
+	var bodyMessage string
+	err = json.Unmarshal(body["Message"], &bodyMessage)
+	if err != nil {
+		ctx.Warn("'Message' field could not be parsed: ", err.Error())
+	}
+
+	env := &envelope{Topic: topicName(topicARN), TopicARN: topicARN, Args: bodyMessage}
+
+	if raw, ok := body["MessageAttributes"]; ok {
+		attrs := make(map[string]snsAttribute)
+		if err := json.Unmarshal(raw, &attrs); err != nil {
+			ctx.Warn("'MessageAttributes' field could not be parsed: ", err.Error())
+		}
+
+		env.Attributes = make(map[string]string, len(attrs))
+		for name, attr := range attrs {
+			env.Attributes[name] = attr.Value
+		}
+	}
+
+	return env, nil
+}
+
+// parseRaw parses a raw message. The whole body is the args, and its topic
+// is filled in from the route attribute when it's routed
+func parseRaw(msg Message) (*envelope, error) {
+	if !json.Valid([]byte(msg.Body)) {
+		return nil, reject(FailureInvalidBody, "Message body is not valid json")
+	}
+
+	return &envelope{Attributes: msg.Attributes, Args: msg.Body}, nil
+}
+
+// matchTopic finds the topic config for the message. Keys can be topic names,
+// full ARNs or glob patterns, and if more than one matches the most specific
+// one wins. It returns the key that matched too
+func (q *queue) matchTopic(env *envelope) (string, TopicConfig, bool) {
+	if topic, ok := q.Topics[env.TopicARN]; ok && env.TopicARN != "" {
+		return env.TopicARN, topic, true
+	}
+
+	best, bestRank, found := "", topicRank{}, false
+	for key := range q.Topics {
+		rank, ok := env.matchTopic(key)
+		if !ok {
+			continue
+		}
+
+		// go alphabetically between keys that rank the same, so the choice
+		// doesn't depend on map order
+		if !found || rank.beats(bestRank) || rank == bestRank && key < best {
+			best, bestRank, found = key, rank, true
+		}
+	}
+
+	if !found {
+		return "", TopicConfig{}, false
+	}
+
+	return best, q.Topics[best], true
+}
+
+// The tiers of topic keys, from the least specific to the most
+const (
+	tierNamePattern = iota
+	tierARNPattern
+	tierName
+	tierARN
+)
+
+// topicRank is how specific a topic key that matched a message is. A key in
+// a higher tier always wins, and within a tier the fewest wildcards win
+type topicRank struct {
+	tier      int
+	wildcards int
+}
+
+// beats returns true if the rank is more specific than the other one
+func (r topicRank) beats(other topicRank) bool {
+	if r.tier != other.tier {
+		return r.tier > other.tier
+	}
+
+	return r.wildcards < other.wildcards
+}
+
+// matchTopic checks a topic key against the message, and ranks it if it
+// matches: an exact ARN, then an exact name, then an ARN pattern, then a
+// name pattern
+func (e *envelope) matchTopic(key string) (topicRank, bool) {
+	if e.TopicARN != "" && key == e.TopicARN {
+		return topicRank{tier: tierARN}, true
+	}
+
+	if !isTopicPattern(key) {
+		return topicRank{tier: tierName}, key == e.Topic
+	}
+
+	// patterns starting with arn: match the whole ARN, others just the name
+	rank := topicRank{tier: tierNamePattern, wildcards: strings.Count(key, "*") + strings.Count(key, "?") + strings.Count(key, "[")}
+	target := e.Topic
+	if isTopicARN(key) && e.TopicARN != "" {
+		rank.tier, target = tierARNPattern, e.TopicARN
+	}
+
+	ok, _ := path.Match(key, target)
+	return rank, ok
+}
+
+// isTopicARN returns true if the topic key is a full ARN or a pattern for one
+func isTopicARN(key string) bool {
+	return strings.HasPrefix(key, "arn:")
+}
+
+// isTopicPattern returns true if the topic key is a glob pattern
+func isTopicPattern(key string) bool {
+	return strings.ContainsAny(key, "*?[")
+}
+
+// matchRoutes returns the workers of every route the message matches. The
+// same worker is only returned once. It also returns the label of the first
+// route that matched
+func (q *queue) matchRoutes(env *envelope) ([]TopicConfig, string) {
+	var topics []TopicConfig
+	var label string
+	seen := make(map[string]bool)
+
+	for i, route := range q.Routes {
+		if !route.matches(env) {
+			continue
+		}
+
+		if label == "" {
+			label = route.label(i)
+		}
+
+		for _, worker := range route.Workers {
+			key := worker.Class + "\x00" + worker.Queue
+			if !seen[key] {
+				seen[key] = true
+				topics = append(topics, worker)
+			}
+		}
+	}
+
+	return topics, label
+}
+
+// label is what messages the route matched are counted under: its topic if
+// it has one, or else its place in the config
+func (r RouteConfig) label(i int) string {
+	if r.Topic != "" {
+		return r.Topic
+	}
+
+	return fmt.Sprintf("routes[%d]", i)
+}
+
+// matches checks every condition of the route against the message
+func (r RouteConfig) matches(env *envelope) bool {
+	if r.Topic != "" {
+		if _, ok := env.matchTopic(r.Topic); !ok {
+			return false
+		}
+	}
+
+	for name, want := range r.Attributes {
+		if got, ok := env.Attributes[name]; !ok || got != want {
+			return false
+		}
+	}
+
+	if len(r.Fields) == 0 {
+		return true
+	}
+
+	if !env.parsed {
+		env.parsed = true
+		json.Unmarshal([]byte(env.Args), &env.payload)
+	}
+
+	for path, want := range r.Fields {
+		if got, ok := lookupField(env.payload, path); !ok || got != want {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookupField finds the value at a dotted path like `data.items.0.id` in a
+// parsed json document. Scalars are returned as strings, and anything else
+// doesn't match
+func lookupField(doc interface{}, path string) (string, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return "", false
+			}
+			doc = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			doc = node[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch value := doc.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	case nil:
+		return "null", true
+	default:
+		return "", false
+	}
+}
+
+func topicName(topicARN string) string {
+	toks := strings.Split(topicARN, ":")
+	return toks[len(toks)-1]
+}
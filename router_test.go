@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupField(t *testing.T) {
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{
+		"name": "loan",
+		"amount": 12.5,
+		"count": 3,
+		"funded": true,
+		"closed": null,
+		"data": {"items": [{"id": "a"}, {"id": "b"}]}
+	}`), &doc)
+	require.Nil(t, err)
+
+	cases := []struct {
+		path  string
+		value string
+		found bool
+	}{
+		{"name", "loan", true},
+		{"amount", "12.5", true},
+		{"count", "3", true},
+		{"funded", "true", true},
+		{"closed", "null", true},
+		{"data.items.1.id", "b", true},
+		{"data.items.2.id", "", false},
+		{"data.items.x", "", false},
+		{"data.items", "", false},
+		{"data", "", false},
+		{"missing", "", false},
+		{"name.first", "", false},
+	}
+
+	for _, c := range cases {
+		value, found := lookupField(doc, c.path)
+		require.Equal(t, c.found, found, c.path)
+		require.Equal(t, c.value, value, c.path)
+	}
+}
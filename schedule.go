@@ -0,0 +1,43 @@
+package main
+
+import "time"
+
+// Schedule is how often each receiver polls its queue
+type Schedule struct {
+	Receivers   int           // receivers per queue
+	Interval    time.Duration // between polls, unless the last batch was full or empty
+	MaxInterval time.Duration // the longest to back off to while the queue is empty
+}
+
+// pollBackoff works out how long a single receiver waits between polls. It
+// polls again right away while batches come back full, since there's more
+// waiting, and backs off exponentially while they come back empty
+type pollBackoff struct {
+	Schedule
+	empties int // empty polls in a row
+}
+
+// next returns how long to wait after a poll with the given result
+func (b *pollBackoff) next(result PollResult) time.Duration {
+	switch result {
+	case PollFull:
+		b.empties = 0
+		return 0
+	case PollPartial:
+		b.empties = 0
+		return b.Interval
+	}
+
+	b.empties++
+
+	delay := b.Interval
+	for i := 1; i < b.empties && delay < b.MaxInterval; i++ {
+		delay *= 2
+	}
+
+	if delay > b.MaxInterval {
+		delay = b.MaxInterval
+	}
+
+	return delay
+}
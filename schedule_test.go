@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollBackoff(t *testing.T) {
+	backoff := &pollBackoff{Schedule: Schedule{Interval: 100 * time.Millisecond, MaxInterval: time.Second}}
+
+	// full batches are polled again right away, partial ones after the interval
+	require.Equal(t, time.Duration(0), backoff.next(PollFull))
+	require.Equal(t, 100*time.Millisecond, backoff.next(PollPartial))
+
+	// empty batches back off exponentially up to the max
+	var delays []time.Duration
+	for i := 0; i < 6; i++ {
+		delays = append(delays, backoff.next(PollEmpty))
+	}
+	require.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}, delays)
+
+	// anything that isn't empty starts over
+	require.Equal(t, 100*time.Millisecond, backoff.next(PollPartial))
+	require.Equal(t, 100*time.Millisecond, backoff.next(PollEmpty))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snsEnvelope is the parts of an SNS envelope that are signed
+type snsEnvelope struct {
+	Type             string
+	MessageID        string
+	Subject          *string
+	Message          string
+	Timestamp        string
+	TopicARN         string
+	Token            string
+	SubscribeURL     string
+	Signature        string
+	SignatureVersion string
+	SigningCertURL   string
+}
+
+// signedFields returns the fields that SNS signs for each type of message, in
+// the order they're signed
+func (e *snsEnvelope) signedFields() [][2]string {
+	fields := [][2]string{{"Message", e.Message}, {"MessageId", e.MessageID}}
+
+	if e.Type == "Notification" {
+		if e.Subject != nil {
+			fields = append(fields, [2]string{"Subject", *e.Subject})
+		}
+	} else {
+		fields = append(fields, [2]string{"SubscribeURL", e.SubscribeURL})
+	}
+
+	fields = append(fields, [2]string{"Timestamp", e.Timestamp})
+	if e.Type != "Notification" {
+		fields = append(fields, [2]string{"Token", e.Token})
+	}
+
+	return append(fields, [2]string{"TopicArn", e.TopicARN}, [2]string{"Type", e.Type})
+}
+
+// stringToSign builds the string SNS signs, which is each field name and value
+// on their own lines
+func (e *snsEnvelope) stringToSign() string {
+	var b strings.Builder
+	for _, field := range e.signedFields() {
+		b.WriteString(field[0])
+		b.WriteString("\n")
+		b.WriteString(field[1])
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// SignatureVerifier checks the signatures on SNS envelopes
+type SignatureVerifier struct {
+	CertHosts []string
+	Certs     *CertCache
+}
+
+// NewSignatureVerifier creates a verifier for the given config that shares
+// the default cert cache. Returns nil if verification is turned off
+func NewSignatureVerifier(conf SignatureConfig) *SignatureVerifier {
+	if !conf.Verify {
+		return nil
+	}
+
+	hosts := conf.CertHosts
+	if len(hosts) == 0 {
+		hosts = DefaultCertHosts
+	}
+
+	return &SignatureVerifier{CertHosts: hosts, Certs: defaultCertCache}
+}
+
+// Verify checks the signature on an SNS envelope. It returns a RejectedError
+// if the signature is missing or wrong, or any other error if the signing
+// cert couldn't be fetched
+func (v *SignatureVerifier) Verify(body string) error {
+	env := new(snsEnvelope)
+	if err := json.Unmarshal([]byte(body), env); err != nil {
+		return reject(FailureInvalidBody, "Message body could not be parsed: %s", err.Error())
+	}
+
+	var hash crypto.Hash
+	switch env.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	case "":
+		return reject(FailureInvalidSignature, "Message is not signed")
+	default:
+		return reject(FailureInvalidSignature, "Unknown signature version: %s", env.SignatureVersion)
+	}
+
+	if err := v.checkCertURL(env.SigningCertURL); err != nil {
+		return reject(FailureInvalidSignature, "Untrusted signing cert: %s", err.Error())
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return reject(FailureInvalidSignature, "Signature could not be decoded: %s", err.Error())
+	}
+
+	cert, err := v.Certs.Get(env.SigningCertURL)
+	if err != nil {
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			return err
+		}
+
+		return fmt.Errorf("couldn't fetch signing cert: %s", err.Error())
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return reject(FailureInvalidSignature, "Signing cert is expired or not yet valid")
+	}
+
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return reject(FailureInvalidSignature, "Signing cert doesn't have an RSA key")
+	}
+
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(env.stringToSign()))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(env.stringToSign()))
+		digest = sum[:]
+	}
+
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+		return reject(FailureInvalidSignature, "Signature doesn't match")
+	}
+
+	return nil
+}
+
+// checkCertURL makes sure the cert comes from one of the allowed hosts over
+// https, so a forged message can't point at a cert of its own
+func (v *SignatureVerifier) checkCertURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "https" {
+		return fmt.Errorf("%q is not https", raw)
+	}
+
+	if !strings.HasSuffix(u.Path, ".pem") {
+		return fmt.Errorf("%q is not a pem file", raw)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range v.CertHosts {
+		if matchHost(strings.ToLower(allowed), host) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s is not an allowed cert host", host)
+}
+
+// matchHost matches a host against a pattern one label at a time, so a
+// wildcard can't match across dots. Otherwise `sns.*.amazonaws.com` would
+// match hosts like `sns.s3.amazonaws.com` that anyone can serve files from
+func matchHost(pattern, host string) bool {
+	patterns, labels := strings.Split(pattern, "."), strings.Split(host, ".")
+	if len(patterns) != len(labels) {
+		return false
+	}
+
+	for i := range patterns {
+		if ok, _ := path.Match(patterns[i], labels[i]); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// certTimeout is how long fetching a signing cert can take
+const certTimeout = 10 * time.Second
+
+// defaultCertCache is shared by every queue, since SNS signs everything with
+// the same few certs
+var defaultCertCache = NewCertCache(httpCertFetcher(&http.Client{Timeout: certTimeout}))
+
+// CertFetcher fetches the pem encoded cert at a url
+type CertFetcher func(url string) ([]byte, error)
+
+// CertCache fetches signing certs and keeps them by url. SNS gives new certs
+// new urls, so they're never refetched
+type CertCache struct {
+	fetch CertFetcher
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+// NewCertCache creates an empty cache that fetches certs with the fetcher
+func NewCertCache(fetch CertFetcher) *CertCache {
+	return &CertCache{fetch: fetch, certs: make(map[string]*x509.Certificate)}
+}
+
+// Get returns the cert at the url, fetching it if it isn't cached. Certs
+// that can't be parsed are a RejectedError, since fetching them again won't
+// help
+func (c *CertCache) Get(url string) (*x509.Certificate, error) {
+	c.mu.Lock()
+	cert, ok := c.certs[url]
+	c.mu.Unlock()
+
+	if ok {
+		return cert, nil
+	}
+
+	data, err := c.fetch(url)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, reject(FailureInvalidSignature, "Signing cert is not pem encoded")
+	}
+
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, reject(FailureInvalidSignature, "Signing cert could not be parsed: %s", err.Error())
+	}
+
+	c.mu.Lock()
+	c.certs[url] = cert
+	c.mu.Unlock()
+
+	return cert, nil
+}
+
+// httpCertFetcher fetches certs over http with the given client
+func httpCertFetcher(client *http.Client) CertFetcher {
+	return func(url string) ([]byte, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("got %s fetching %s", resp.Status, url)
+		}
+
+		return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	}
+}
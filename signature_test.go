@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const testCertURL = "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem"
+
+func TestSignature(t *testing.T) {
+	suite.Run(t, new(SignatureTestSuite))
+}
+
+type SignatureTestSuite struct {
+	suite.Suite
+	key      *rsa.PrivateKey
+	valid    []byte
+	cert     []byte
+	fetches  int
+	verifier *SignatureVerifier
+	assert   *require.Assertions
+}
+
+func (s *SignatureTestSuite) SetupSuite() {
+	s.assert = require.New(s.T())
+
+	var err error
+	s.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	s.assert.Nil(err)
+
+	s.valid = selfSignedCert(s.T(), s.key, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+func (s *SignatureTestSuite) SetupTest() {
+	s.assert = require.New(s.T())
+	s.fetches = 0
+	s.cert = s.valid
+
+	s.verifier = &SignatureVerifier{
+		CertHosts: DefaultCertHosts,
+		Certs: NewCertCache(func(url string) ([]byte, error) {
+			s.fetches++
+			return s.cert, nil
+		}),
+	}
+}
+
+// sign fills in the signature fields of the envelope with the test key
+func (s *SignatureTestSuite) sign(env *snsEnvelope, version string) string {
+	env.SignatureVersion = version
+	if env.SigningCertURL == "" {
+		env.SigningCertURL = testCertURL
+	}
+
+	var signature []byte
+	var err error
+	if version == "1" {
+		sum := sha1.Sum([]byte(env.stringToSign()))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, sum[:])
+	} else {
+		sum := sha256.Sum256([]byte(env.stringToSign()))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	}
+	s.assert.Nil(err)
+
+	env.Signature = base64.StdEncoding.EncodeToString(signature)
+	return marshalEnvelope(s.T(), env)
+}
+
+func (s *SignatureTestSuite) TestVerify() {
+	subject := "funded"
+
+	for _, version := range []string{"1", "2"} {
+		body := s.sign(&snsEnvelope{
+			Type:      "Notification",
+			MessageID: "abc",
+			Subject:   &subject,
+			Message:   `{"id":1}`,
+			Timestamp: "2020-01-01T00:00:00.000Z",
+			TopicARN:  "arn:aws:sns:us-east-1:111:loans",
+		}, version)
+
+		s.assert.Nil(s.verifier.Verify(body), version)
+	}
+
+	// the cert is only fetched once
+	s.assert.Equal(1, s.fetches)
+}
+
+func (s *SignatureTestSuite) TestVerify_Tampered() {
+	env := &snsEnvelope{
+		Type:      "Notification",
+		MessageID: "abc",
+		Message:   `{"id":1}`,
+		Timestamp: "2020-01-01T00:00:00.000Z",
+		TopicARN:  "arn:aws:sns:us-east-1:111:loans",
+	}
+	s.sign(env, "2")
+
+	env.Message = `{"id":2}`
+	s.assertRejected(s.verifier.Verify(marshalEnvelope(s.T(), env)), "Signature doesn't match")
+}
+
+func (s *SignatureTestSuite) TestVerify_Unsigned() {
+	body := MockMessage(`{"id":1}`, "arn:aws:sns:us-east-1:111:loans").Body
+	s.assertRejected(s.verifier.Verify(body), "Message is not signed")
+}
+
+func (s *SignatureTestSuite) TestVerify_UntrustedCert() {
+	for _, url := range []string{
+		"https://attacker.example.com/SimpleNotificationService-test.pem",
+		"http://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem",
+		"https://sns.us-east-1.amazonaws.com/cert.txt",
+		"https://sns.us-east-1.amazonaws.com.example.com/cert.pem",
+		"https://sns.s3.us-east-1.amazonaws.com/cert.pem",
+		"https://sns.s3.amazonaws.com/cert.pem",
+	} {
+		body := s.sign(&snsEnvelope{
+			Type:           "Notification",
+			Message:        `{"id":1}`,
+			TopicARN:       "arn:aws:sns:us-east-1:111:loans",
+			SigningCertURL: url,
+		}, "2")
+
+		err := s.verifier.Verify(body)
+		var rejected *RejectedError
+		s.assert.True(errors.As(err, &rejected), url)
+		s.assert.Equal(FailureInvalidSignature, rejected.Class)
+	}
+
+	// untrusted certs are never fetched
+	s.assert.Equal(0, s.fetches)
+}
+
+func TestMatchHost(t *testing.T) {
+	for _, host := range []string{"sns.us-east-1.amazonaws.com", "sns.us-gov-west-1.amazonaws.com", "sns.cn-north-1.amazonaws.com.cn"} {
+		require.True(t, matchHost(DefaultCertHosts[0], host) || matchHost(DefaultCertHosts[1], host), host)
+	}
+
+	require.False(t, matchHost("sns.*.amazonaws.com", "sns.a.b.amazonaws.com"))
+	require.True(t, matchHost("*.example.com", "certs.example.com"))
+}
+
+func (s *SignatureTestSuite) TestVerify_ExpiredCert() {
+	s.cert = selfSignedCert(s.T(), s.key, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+
+	body := s.sign(&snsEnvelope{Type: "Notification", Message: `{"id":1}`}, "2")
+	s.assertRejected(s.verifier.Verify(body), "Signing cert is expired or not yet valid")
+}
+
+func (s *SignatureTestSuite) TestVerify_FetchError() {
+	s.verifier.Certs = NewCertCache(func(url string) ([]byte, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	body := s.sign(&snsEnvelope{Type: "Notification", Message: `{"id":1}`}, "2")
+	err := s.verifier.Verify(body)
+
+	// fetch errors are retried rather than rejected
+	var rejected *RejectedError
+	s.assert.False(errors.As(err, &rejected))
+	s.assert.EqualError(err, "couldn't fetch signing cert: connection refused")
+}
+
+func (s *SignatureTestSuite) TestQueue_Verify() {
+	workerClient := &MockWorkerClient{EnqueuedJID: "jid"}
+	sqsClient := &MockSQSClient{}
+	deadLetter := &MockSQSClient{}
+
+	q := &queue{
+		WorkerClient: workerClient,
+		SQSClient:    sqsClient,
+		DeadLetter:   deadLetter,
+		SidekiqQueue: "background",
+		Topics:       map[string]TopicConfig{"loans": {Class: "LoanWorker"}},
+		Failures:     FailureConfig{DeadLetterQueue: "dlq", InvalidSignature: PolicyDeadLetter},
+		Verifier:     s.verifier,
+	}
+
+	signed := Message{MessageID: "1", Body: s.sign(&snsEnvelope{
+		Type:     "Notification",
+		Message:  `{"id":1}`,
+		TopicARN: "arn:aws:sns:us-east-1:111:loans",
+	}, "2")}
+	forged := MockMessage(`{"id":2}`, "arn:aws:sns:us-east-1:111:loans")
+	forged.MessageID = "2"
+
+	sqsClient.Fetchable = []Message{signed, forged}
+	q.Poll(context.Background())
+
+	s.assert.Equal([][]string{{"LoanWorker", `{"id":1}`}}, workerClient.Enqueued)
+	s.assert.Len(deadLetter.Sent, 1)
+	s.assert.Equal(forged.Body, deadLetter.Sent[0].Body)
+	s.assert.Equal("invalid_signature", deadLetter.Sent[0].Attributes["ScoutFailure"])
+}
+
+func (s *SignatureTestSuite) assertRejected(err error, message string) {
+	var rejected *RejectedError
+	s.assert.True(errors.As(err, &rejected))
+	s.assert.Equal(FailureInvalidSignature, rejected.Class)
+	s.assert.EqualError(err, message)
+}
+
+func selfSignedCert(t *testing.T, key *rsa.PrivateKey, notBefore, notAfter time.Time) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// marshalEnvelope encodes an envelope with the field names SNS uses
+func marshalEnvelope(t *testing.T, env *snsEnvelope) string {
+	data, err := json.Marshal(map[string]interface{}{
+		"Type":             env.Type,
+		"MessageId":        env.MessageID,
+		"Subject":          env.Subject,
+		"Message":          env.Message,
+		"Timestamp":        env.Timestamp,
+		"TopicArn":         env.TopicARN,
+		"Signature":        env.Signature,
+		"SignatureVersion": env.SignatureVersion,
+		"SigningCertURL":   env.SigningCertURL,
+	})
+	require.Nil(t, err)
+
+	return string(data)
+}
+
+// fixtureCert and fixtureNotification were made offline with openssl, which
+// signed fixtureStringToSign with SHA256. They pin the string SNS signs
+// without going through the code that builds it. The cert is self-signed
+// rather than one of SNS's, since theirs expire, and lasts until 2126
+const fixtureCert = `-----BEGIN CERTIFICATE-----
+MIIDHDCCAgSgAwIBAgIBATANBgkqhkiG9w0BAQsFADAmMSQwIgYDVQQDDBtzbnMu
+dXMtZWFzdC0xLmFtYXpvbmF3cy5jb20wIBcNMjYxMDE3MjMyMTMzWhgPMjEyNjA5
+MjMyMzIxMzNaMCYxJDAiBgNVBAMMG3Nucy51cy1lYXN0LTEuYW1hem9uYXdzLmNv
+bTCCASIwDQYJKoZIhvcNAQEBBQADggEPADCCAQoCggEBAOFyC/y/Ak8NYbR85rcc
+KyZZdqRXTjlMUVrL54uEoBpso1SYLxWFnMu08ltwe1WjC8h1xaDiuVqxH4iEUjtt
+h6X/YXNIHpGhlB/8Y11ngQKpXq+GL2xlu32caHiJ8eGeAJSjIO4V4WqrtKr3gO8w
+UJiPyb9jcTw0CDiooNC0E+5FVMozVEH46FDCB1TNplhhLq9McNGZP0iTAL2SmawK
+JXwLS+5vQQduOhBMNn01wa+kq8/naerJ38tCW+G8rUPK0vsl8y5RVhkUy/r45grB
+92zkZLHkNpOFV+QiJF/lUVPqPDbG+lF3WRce/kC7x4yOR4d9WQzy2w7GPbWAcm78
+7U0CAwEAAaNTMFEwHQYDVR0OBBYEFKIhNBbeD5eITZgkUCYu1r24ZC9GMB8GA1Ud
+IwQYMBaAFKIhNBbeD5eITZgkUCYu1r24ZC9GMA8GA1UdEwEB/wQFMAMBAf8wDQYJ
+KoZIhvcNAQELBQADggEBAHmJcHNfnn9jLilWJfjs6ag8TMFf8dpN2oGk9FJZ1eiW
+OoozMOAU/EgfXlgIob9Yt4/eaS2M/5cYeqw+OIsxI7DOVcZ1riYk06cZ+z28WX1m
+uJq9YGJo/73IwTNQwlcje43chk5Mikq2BiatwF/izwmF0JwgzlkmUi/sHfi/4Y4T
+iBryh8iD4ZGFE6TEnrjGwhB6okt8Ky2IaInA4CR1CFwNMQD1nGZ42l/vqjF3htzh
+oUHyXgyNMG56COQ8KdkIfjjwezhjbGnFXPu8ZbyjI+YMq285SO5tFjPSUt2ZWwf+
+daKraXI7XVJttIIZTpg7DQ0xl72xe2PBiE5QA4RJrgE=
+-----END CERTIFICATE-----
+`
+
+const fixtureNotification = `{
+  "Type" : "Notification",
+  "MessageId" : "5f6b1c3e-4a2d-4e8f-9b7a-0c1d2e3f4a5b",
+  "TopicArn" : "arn:aws:sns:us-east-1:123456789012:loans",
+  "Subject" : "Loan funded",
+  "Message" : "Loan 42 was funded.\nAmount: 100",
+  "Timestamp" : "2024-05-01T12:00:00.000Z",
+  "SignatureVersion" : "2",
+  "Signature" : "YK2aOs9TMK28zIoMCHCyBRcXlbiystRGRJoRxNHFj41/D1bqwaiRDF5S6BOjENmb2+wVzlAC4RRKS8RNwLuFzL2DshRFt74x/vAQcJRpVKrNQEG22Boc1uts/wffRRGmPovnXwcZvOsudhioFqMlQL/BzMPYCClnAy/i0/JIUqDA8OLiPP3vF3AKvsayE4sQvDXPfppT9CyBYnzUMNj7VxZwmlGibSI2WOvDYT4P1ZDBc+6B6sZUBRsZ8zvPym+EI76tB7uBKC+TXOwTNx73SjFVN+/D0B3vkQUoO5L1TMwHSctsRcp5mWs18nc7+5SPr+li6GC3Ify6oRdy3q2nBg==",
+  "SigningCertURL" : "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-fixture.pem",
+  "UnsubscribeURL" : "https://sns.us-east-1.amazonaws.com/?Action=Unsubscribe&SubscriptionArn=arn:aws:sns:us-east-1:123456789012:loans:1"
+}`
+
+const fixtureStringToSign = "Message\nLoan 42 was funded.\nAmount: 100\n" +
+	"MessageId\n5f6b1c3e-4a2d-4e8f-9b7a-0c1d2e3f4a5b\n" +
+	"Subject\nLoan funded\n" +
+	"Timestamp\n2024-05-01T12:00:00.000Z\n" +
+	"TopicArn\narn:aws:sns:us-east-1:123456789012:loans\n" +
+	"Type\nNotification\n"
+
+func TestVerify_Fixture(t *testing.T) {
+	env := new(snsEnvelope)
+	require.Nil(t, json.Unmarshal([]byte(fixtureNotification), env))
+	require.Equal(t, fixtureStringToSign, env.stringToSign())
+
+	verifier := &SignatureVerifier{
+		CertHosts: DefaultCertHosts,
+		Certs: NewCertCache(func(url string) ([]byte, error) {
+			return []byte(fixtureCert), nil
+		}),
+	}
+	require.Nil(t, verifier.Verify(fixtureNotification))
+
+	// the subject is signed too
+	tampered := strings.Replace(fixtureNotification, "Loan funded", "Loan paid", 1)
+	var rejected *RejectedError
+	require.True(t, errors.As(verifier.Verify(tampered), &rejected))
+}
@@ -1,53 +1,103 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
-// SQSClient is an interface for SQS
+// SQSClient is an interface for SQS. Every call gives up when the context is
+// done
 type SQSClient interface {
 	// Fetch returns the next batch of SQS messages
-	Fetch() ([]Message, error)
+	Fetch(ctx context.Context) ([]Message, error)
 
 	// Delete deletes a single message from SQS
-	Delete(Message) error
+	Delete(ctx context.Context, message Message) error
+
+	// DeleteBatch deletes messages from SQS, up to 10 per API call. It
+	// returns the messages that couldn't be deleted along with why
+	DeleteBatch(ctx context.Context, messages []Message) []MessageError
+
+	// ChangeVisibility hides a message for the given number of seconds from
+	// now. Zero makes it visible right away
+	ChangeVisibility(ctx context.Context, message Message, timeout int64) error
+
+	// ChangeVisibilityBatch hides messages for the given number of seconds
+	// from now, up to 10 per API call. It returns the messages that couldn't
+	// be changed along with why
+	ChangeVisibilityBatch(ctx context.Context, messages []Message, timeout int64) []MessageError
+
+	// Send sends a new message with the given body and string attributes
+	Send(ctx context.Context, body string, attributes map[string]string) error
+}
+
+// MessageError is an error that happened to a single message in a batch.
+// Index is where the message was in the messages passed in
+type MessageError struct {
+	Message Message
+	Index   int
+	Err     error
 }
 
+// MaxBatchSize is the most entries SQS accepts in a single batch call
+const MaxBatchSize = 10
+
 // Message is the internal representation of an SQS message
 type Message struct {
 	MessageID     string
 	Body          string
 	ReceiptHandle string
+	ReceiveCount  int64             // how many times SQS has handed out the message
+	Attributes    map[string]string // the message attributes with string values
 }
 
 type sdkClient struct {
 	service *sqs.SQS
+	name    string // for metrics
 	url     string
 	SQSConfig
 }
 
-// NewAWSSQSClient creates an SQS client that talks to AWS on the given queue
-func NewAWSSQSClient(conf AWSConfig, queueName string, sqsConf SQSConfig) (SQSClient, error) {
-	creds := credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, "")
-	sess, err := session.NewSession(&aws.Config{Region: formatRegion(conf.Region), Credentials: creds})
-
+// NewAWSSQSClient creates an SQS client that talks to AWS on the given queue.
+// If the config has an endpoint, it talks to that instead, which works with
+// anything that speaks the SQS API like ElasticMQ or LocalStack. If the queue
+// has a url, it's used as is rather than looked up by name.
+func NewAWSSQSClient(conf AWSConfig, queue QueueConfig, sqsConf SQSConfig) (SQSClient, error) {
+	sess, err := NewAWSSession(conf)
 	if err != nil {
 		return nil, err
 	}
 
+	serviceConf := aws.NewConfig()
+	if conf.Endpoint != "" {
+		serviceConf = serviceConf.WithEndpoint(conf.Endpoint)
+	}
+
 	client := &sdkClient{
-		service:   sqs.New(sess),
+		service:   sqs.New(sess, serviceConf),
+		name:      queue.DisplayName(),
+		url:       queue.URL,
 		SQSConfig: sqsConf,
 	}
 
-	resp, err := client.service.GetQueueUrl(&sqs.GetQueueUrlInput{
-		QueueName: &queueName,
+	if client.url != "" {
+		return client, nil
+	}
+
+	ctx, cancel := client.withTimeout(context.Background(), 0)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := client.service.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: &queue.Name,
 	})
+	client.observe("GetQueueUrl", start, err)
 
 	if err != nil {
 		return nil, err
@@ -57,13 +107,23 @@ func NewAWSSQSClient(conf AWSConfig, queueName string, sqsConf SQSConfig) (SQSCl
 	return client, nil
 }
 
-func (s *sdkClient) Fetch() ([]Message, error) {
-	res, err := s.service.ReceiveMessage(&sqs.ReceiveMessageInput{
-		QueueUrl:            &s.url,
-		MaxNumberOfMessages: &s.maxNumberOfMessages,
-		WaitTimeSeconds:     &s.waitTimeSeconds,
-		VisibilityTimeout:   &s.visibilityTimeout,
+func (s *sdkClient) Fetch(ctx context.Context) ([]Message, error) {
+	// long polls take up to the wait time before they even respond. Without
+	// one set this is a short poll
+	wait := aws.Int64Value(s.WaitTimeSeconds)
+	ctx, cancel := s.withTimeout(ctx, wait)
+	defer cancel()
+
+	start := time.Now()
+	res, err := s.service.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              &s.url,
+		MaxNumberOfMessages:   &s.MaxNumberOfMessages,
+		WaitTimeSeconds:       &wait,
+		VisibilityTimeout:     &s.VisibilityTimeout,
+		AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+		MessageAttributeNames: []*string{aws.String("All")},
 	})
+	s.observe("ReceiveMessage", start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -71,24 +131,225 @@ func (s *sdkClient) Fetch() ([]Message, error) {
 	msgs := make([]Message, len(res.Messages))
 
 	for i, m := range res.Messages {
+		receiveCount, _ := strconv.ParseInt(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]), 10, 64)
+
 		msgs[i] = Message{
 			MessageID:     *m.MessageId,
 			Body:          *m.Body,
 			ReceiptHandle: *m.ReceiptHandle,
+			ReceiveCount:  receiveCount,
+			Attributes:    stringAttributes(m.MessageAttributes),
 		}
 	}
 
 	return msgs, nil
 }
 
-func (s *sdkClient) Delete(message Message) error {
-	_, err := s.service.DeleteMessage(&sqs.DeleteMessageInput{
+func (s *sdkClient) Delete(ctx context.Context, message Message) error {
+	ctx, cancel := s.withTimeout(ctx, 0)
+	defer cancel()
+
+	start := time.Now()
+	_, err := s.service.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
 		QueueUrl:      &s.url,
 		ReceiptHandle: &message.ReceiptHandle,
 	})
+	s.observe("DeleteMessage", start, err)
 	return err
 }
 
+func (s *sdkClient) ChangeVisibility(ctx context.Context, message Message, timeout int64) error {
+	ctx, cancel := s.withTimeout(ctx, 0)
+	defer cancel()
+
+	start := time.Now()
+	_, err := s.service.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &s.url,
+		ReceiptHandle:     &message.ReceiptHandle,
+		VisibilityTimeout: &timeout,
+	})
+	s.observe("ChangeMessageVisibility", start, err)
+	return err
+}
+
+func (s *sdkClient) Send(ctx context.Context, body string, attributes map[string]string) error {
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(attributes))
+	for name, value := range attributes {
+		attrs[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	ctx, cancel := s.withTimeout(ctx, 0)
+	defer cancel()
+
+	start := time.Now()
+	_, err := s.service.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          &s.url,
+		MessageBody:       &body,
+		MessageAttributes: attrs,
+	})
+	s.observe("SendMessage", start, err)
+	return err
+}
+
+func (s *sdkClient) DeleteBatch(ctx context.Context, messages []Message) []MessageError {
+	return inBatches(messages, func(batch []Message) []MessageError {
+		return s.deleteBatch(ctx, batch)
+	})
+}
+
+// deleteBatch deletes a single batch of at most MaxBatchSize messages. The
+// entries are identified by their index in the batch.
+func (s *sdkClient) deleteBatch(ctx context.Context, batch []Message) []MessageError {
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+	for i := range batch {
+		entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: &batch[i].ReceiptHandle,
+		}
+	}
+
+	ctx, cancel := s.withTimeout(ctx, 0)
+	defer cancel()
+
+	start := time.Now()
+	res, err := s.service.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: &s.url,
+		Entries:  entries,
+	})
+	s.observe("DeleteMessageBatch", start, err)
+
+	if err != nil {
+		return batchFailed(batch, err)
+	}
+
+	return batchFailures(batch, res.Failed)
+}
+
+func (s *sdkClient) ChangeVisibilityBatch(ctx context.Context, messages []Message, timeout int64) []MessageError {
+	return inBatches(messages, func(batch []Message) []MessageError {
+		return s.changeVisibilityBatch(ctx, batch, timeout)
+	})
+}
+
+// changeVisibilityBatch changes the visibility of a single batch of at most
+// MaxBatchSize messages, identified by their index like deleteBatch
+func (s *sdkClient) changeVisibilityBatch(ctx context.Context, batch []Message, timeout int64) []MessageError {
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(batch))
+	for i := range batch {
+		entries[i] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     &batch[i].ReceiptHandle,
+			VisibilityTimeout: &timeout,
+		}
+	}
+
+	ctx, cancel := s.withTimeout(ctx, 0)
+	defer cancel()
+
+	start := time.Now()
+	res, err := s.service.ChangeMessageVisibilityBatchWithContext(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: &s.url,
+		Entries:  entries,
+	})
+	s.observe("ChangeMessageVisibilityBatch", start, err)
+
+	if err != nil {
+		return batchFailed(batch, err)
+	}
+
+	return batchFailures(batch, res.Failed)
+}
+
+// inBatches calls the function with the messages split into batches of at
+// most MaxBatchSize, and collects the failures with their indexes in all of
+// the messages
+func inBatches(messages []Message, call func(batch []Message) []MessageError) []MessageError {
+	var failed []MessageError
+
+	for start := 0; start < len(messages); start += MaxBatchSize {
+		end := start + MaxBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		for _, f := range call(messages[start:end]) {
+			f.Index += start
+			failed = append(failed, f)
+		}
+	}
+
+	return failed
+}
+
+// batchFailed fails every message in a batch whose whole call failed
+func batchFailed(batch []Message, err error) []MessageError {
+	failed := make([]MessageError, len(batch))
+	for i, msg := range batch {
+		failed[i] = MessageError{Message: msg, Index: i, Err: err}
+	}
+
+	return failed
+}
+
+// batchFailures turns the failed entries of a batch call back into the
+// messages they were for
+func batchFailures(batch []Message, entries []*sqs.BatchResultErrorEntry) []MessageError {
+	failed := make([]MessageError, 0, len(entries))
+	for _, entry := range entries {
+		i, err := strconv.Atoi(aws.StringValue(entry.Id))
+		if err != nil || i < 0 || i >= len(batch) {
+			continue
+		}
+
+		failed = append(failed, MessageError{
+			Message: batch[i],
+			Index:   i,
+			Err:     fmt.Errorf("%s: %s", aws.StringValue(entry.Code), aws.StringValue(entry.Message)),
+		})
+	}
+
+	return failed
+}
+
+// withTimeout limits a single call to the request timeout, plus the given
+// number of extra seconds
+func (s *sdkClient) withTimeout(ctx context.Context, extra int64) (context.Context, context.CancelFunc) {
+	timeout := s.RequestTimeout
+	if timeout == 0 {
+		timeout = DefaultRequestTimeout
+	}
+
+	return context.WithTimeout(ctx, time.Duration(timeout+extra)*time.Second)
+}
+
+// observe records how long an SQS call took and whether it failed
+func (s *sdkClient) observe(operation string, start time.Time, err error) {
+	metrics.SQSRequests.WithLabelValues(s.name, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.SQSErrors.WithLabelValues(s.name, operation).Inc()
+	}
+}
+
+// stringAttributes picks out the message attributes that have a string
+// value, which includes numbers. Binary attributes are skipped
+func stringAttributes(attrs map[string]*sqs.MessageAttributeValue) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string, len(attrs))
+	for name, attr := range attrs {
+		if attr.StringValue != nil {
+			values[name] = *attr.StringValue
+		}
+	}
+
+	return values
+}
+
 func formatRegion(region string) *string {
 	newRegion := strings.NewReplacer(".", "-", "_", "-").Replace(region)
 	return &newRegion
@@ -3,74 +3,76 @@
 package main
 
 import (
+	"context"
+	"os"
 	"testing"
 
-	"github.com/goamz/goamz/sqs"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/stretchr/testify/require"
 )
 
-// These tests are hardcoded to point to actual sqs queues and sns topics.
-// You should think of them as "integration" tests, and in general you don't
-// want to be running these all the time. You will need to provide your own
-// credentials and queue below to run these.
+// These tests talk to a real SQS API. By default they expect an ElasticMQ
+// server on localhost:9324, which can be started with
+//
+//	docker run -p 9324:9324 softwaremill/elasticmq-native
+//
+// Set SCOUT_TEST_SQS_ENDPOINT to point them somewhere else. The queue is
+// created if it doesn't exist, and the credentials are ignored by ElasticMQ.
 
 var config = AWSConfig{
-	AccessKey: "",
-	SecretKey: "",
-	Region:    "",
+	AccessKey: "x",
+	SecretKey: "x",
+	Region:    "elasticmq",
+	Endpoint:  testEndpoint(),
 }
 
-var queueName = ""
+var queueName = "scout-integration"
 
-func queueHandle() *sqs.Queue {
-	sqsHandle, err := sqs.NewFrom(config.AccessKey, config.SecretKey, config.Region)
-	if err != nil {
-		panic(err)
+func testEndpoint() string {
+	if endpoint := os.Getenv("SCOUT_TEST_SQS_ENDPOINT"); endpoint != "" {
+		return endpoint
 	}
 
-	queue, err := sqsHandle.GetQueue(queueName)
-	if err != nil {
-		panic(err)
-	}
+	return "http://localhost:9324"
+}
+
+func queueHandle(t *testing.T) (*sqs.SQS, string) {
+	sess, err := NewAWSSession(config)
+	require.NoError(t, err)
+
+	service := sqs.New(sess, aws.NewConfig().WithEndpoint(config.Endpoint))
+	resp, err := service.CreateQueue(&sqs.CreateQueueInput{QueueName: &queueName})
+	require.NoError(t, err)
+
+	_, err = service.PurgeQueue(&sqs.PurgeQueueInput{QueueUrl: resp.QueueUrl})
+	require.NoError(t, err)
 
-	return queue
+	return service, *resp.QueueUrl
 }
 
-func TestSQS_Init(t *testing.T) {
-	_, err := NewAWSSQSClient(config, queueName)
+func sendMessage(t *testing.T, service *sqs.SQS, url, body string) {
+	_, err := service.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    &url,
+		MessageBody: &body,
+	})
 	require.NoError(t, err)
+}
 
-	// wrong region
-	_, err = NewAWSSQSClient(
-		AWSConfig{
-			AccessKey: config.AccessKey,
-			SecretKey: config.SecretKey,
-			Region:    "us.best",
-		},
-		queueName,
-	)
-	require.Error(t, err)
+func TestSQS_Init(t *testing.T) {
+	_, url := queueHandle(t)
 
-	// wrong creds
-	_, err = NewAWSSQSClient(
-		AWSConfig{
-			AccessKey: "super",
-			SecretKey: "secret",
-			Region:    config.Region,
-		},
-		queueName,
-	)
-	require.Error(t, err)
+	client, err := NewAWSSQSClient(config, QueueConfig{Name: queueName}, SQSConfig{})
+	require.NoError(t, err)
+	require.Equal(t, url, client.(*sdkClient).url)
+
+	// the url can be given instead of looking it up
+	client, err = NewAWSSQSClient(config, QueueConfig{URL: url}, SQSConfig{})
+	require.NoError(t, err)
+	require.Equal(t, url, client.(*sdkClient).url)
 
 	// wrong queue
-	_, err = NewAWSSQSClient(
-		AWSConfig{
-			AccessKey: config.AccessKey,
-			SecretKey: config.SecretKey,
-			Region:    config.Region,
-		},
-		"fake-queue", // hopefully nobody ever makes this
-	)
+	_, err = NewAWSSQSClient(config, QueueConfig{Name: "fake-queue"}, SQSConfig{})
 	require.Error(t, err)
 }
 
@@ -80,22 +82,19 @@ func TestSQS_FetchDelete(t *testing.T) {
 		"bar": 0,
 		"baz": 0,
 	}
-	queue := queueHandle()
-	_, err := queue.SendMessage("foo")
-	require.NoError(t, err)
-	_, err = queue.SendMessage("bar")
-	require.NoError(t, err)
-	_, err = queue.SendMessage("baz")
-	require.NoError(t, err)
+	service, url := queueHandle(t)
+	sendMessage(t, service, url, "foo")
+	sendMessage(t, service, url, "bar")
+	sendMessage(t, service, url, "baz")
 
-	client, err := NewAWSSQSClient(config, queueName)
+	client, err := NewAWSSQSClient(config, QueueConfig{Name: queueName}, SQSConfig{MaxNumberOfMessages: 10})
 	require.NoError(t, err)
 
 	// Loop over and read from the queue unitl there are no messages left.
 	// Doing it this way because even though we set max messages to 10, it
 	// seems that aws almost always gives us back only one anyway
 	for {
-		messages, err := client.Fetch()
+		messages, err := client.Fetch(context.Background())
 		require.NoError(t, err)
 		if len(messages) == 0 {
 			break
@@ -103,7 +102,7 @@ func TestSQS_FetchDelete(t *testing.T) {
 
 		for _, msg := range messages {
 			recd[msg.Body] += 1
-			err := client.Delete(msg)
+			err := client.Delete(context.Background(), msg)
 			require.NoError(t, err)
 		}
 	}
@@ -114,23 +113,75 @@ func TestSQS_FetchDelete(t *testing.T) {
 }
 
 func TestSQS_FetchMany(t *testing.T) {
-	queue := queueHandle()
+	service, url := queueHandle(t)
 
 	// We're filling up the queue to ensure that a call to Fetch will
 	// actually return 10 messages. More sanity than anything else, don't
 	// be too concerned if this fails
 	for i := 0; i < 100; i++ {
-		_, err := queue.SendMessage("foo")
-		require.NoError(t, err)
+		sendMessage(t, service, url, "foo")
 	}
 
-	client, err := NewAWSSQSClient(config, queueName)
+	client, err := NewAWSSQSClient(config, QueueConfig{Name: queueName}, SQSConfig{MaxNumberOfMessages: 10})
 	require.NoError(t, err)
 
-	messages, err := client.Fetch()
+	messages, err := client.Fetch(context.Background())
 	require.NoError(t, err)
 	require.Equal(t, len(messages), 10)
+}
+
+func TestSQS_DeleteBatch(t *testing.T) {
+	service, url := queueHandle(t)
+	for i := 0; i < 15; i++ {
+		sendMessage(t, service, url, "foo")
+	}
+
+	client, err := NewAWSSQSClient(config, QueueConfig{Name: queueName}, SQSConfig{MaxNumberOfMessages: 10})
+	require.NoError(t, err)
+
+	var messages []Message
+	for len(messages) < 15 {
+		batch, err := client.Fetch(context.Background())
+		require.NoError(t, err)
+		messages = append(messages, batch...)
+	}
+
+	// one bad receipt handle only fails its own entry
+	bad := Message{MessageID: "bad", ReceiptHandle: "not-a-receipt-handle"}
+	failed := client.DeleteBatch(context.Background(), append(messages, bad))
+	require.Len(t, failed, 1)
+	require.Equal(t, bad, failed[0].Message)
+
+	messages, err = client.Fetch(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSQS_ChangeVisibilityBatch(t *testing.T) {
+	service, url := queueHandle(t)
+	for i := 0; i < 12; i++ {
+		sendMessage(t, service, url, "foo")
+	}
+
+	client, err := NewAWSSQSClient(config, QueueConfig{Name: queueName}, SQSConfig{MaxNumberOfMessages: 10})
+	require.NoError(t, err)
+
+	var messages []Message
+	for len(messages) < 12 {
+		batch, err := client.Fetch(context.Background())
+		require.NoError(t, err)
+		messages = append(messages, batch...)
+	}
+
+	// one bad receipt handle only fails its own entry
+	bad := Message{MessageID: "bad", ReceiptHandle: "not-a-receipt-handle"}
+	failed := client.ChangeVisibilityBatch(context.Background(), append(messages, bad), 0)
+	require.Len(t, failed, 1)
+	require.Equal(t, bad, failed[0].Message)
+	require.Equal(t, 12, failed[0].Index)
 
-	_, err = queue.Purge()
+	// the rest are visible again right away
+	messages, err = client.Fetch(context.Background())
 	require.NoError(t, err)
+	require.NotEmpty(t, messages)
 }
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationError is a single problem with a config, along with the path to
+// the offending key in the yaml
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (v ValidationError) Error() string {
+	if v.Path == "" {
+		return v.Message
+	}
+
+	return v.Path + ": " + v.Message
+}
+
+// ValidationErrors is every problem found with a config
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, err := range v {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// LoadConfig reads the config from a file with the given name and validates
+// it. If the config is invalid the error is a ValidationErrors listing every
+// problem found, otherwise it's from reading or parsing the file.
+func LoadConfig(file string) (*Config, error) {
+	data, missing, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	errs, err := unknownKeys(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range missing {
+		errs = append(errs, ValidationError{"${" + name + "}", "environment variable is not set and has no default"})
+	}
+
+	errs = append(errs, config.readSecretFiles()...)
+	errs = append(errs, config.applyEnv()...)
+	errs = append(errs, config.Validate()...)
+	if len(errs) > 0 {
+		return config, errs
+	}
+
+	return config, nil
+}
+
+// Validate checks that everything scout needs is present and well formed
+func (c *Config) Validate() ValidationErrors {
+	var errs ValidationErrors
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Redis.Host == "" {
+		add("redis.host", "is required")
+	} else if err := validateHost(c.Redis.Host); err != nil {
+		add("redis.host", "%s", err.Error())
+	}
+
+	if c.AWS.Region == "" {
+		add("aws.region", "is required")
+	}
+
+	if c.AWS.AccessKey == "" && c.AWS.SecretKey != "" {
+		add("aws.access_key", "is required when aws.secret_key is set")
+	}
+
+	if c.AWS.SecretKey == "" && c.AWS.AccessKey != "" {
+		add("aws.secret_key", "is required when aws.access_key is set")
+	}
+
+	if c.AWS.Endpoint != "" {
+		if err := validateURL(c.AWS.Endpoint); err != nil {
+			add("aws.endpoint", "%s", err.Error())
+		}
+	}
+
+	if c.AWS.RoleARN != "" && !strings.HasPrefix(c.AWS.RoleARN, "arn:") {
+		add("aws.role_arn", "must be an ARN, got %q", c.AWS.RoleARN)
+	}
+
+	if c.AWS.ExternalID != "" && c.AWS.RoleARN == "" {
+		add("aws.external_id", "requires aws.role_arn")
+	}
+
+	if c.HTTP.Listen != "" {
+		if err := validateListen(c.HTTP.Listen); err != nil {
+			add("http.listen", "%s", err.Error())
+		}
+	}
+
+	if n := c.Redis.Timeout; n < 0 || n > maxRedisTimeout {
+		add("redis.timeout", "must be between 1 and %d", maxRedisTimeout)
+	}
+
+	if n := c.Concurrency.Receivers; n < 0 || n > maxReceivers {
+		add("concurrency.receivers", "must be between 1 and %d", maxReceivers)
+	}
+
+	if n := c.Concurrency.Workers; n < 0 || n > maxWorkers {
+		add("concurrency.workers", "must be between 1 and %d", maxWorkers)
+	}
+
+	errs = append(errs, validateSQS("sqs", c.SQS)...)
+
+	queues := c.queuePaths()
+	if len(queues) == 0 {
+		add("queues", "at least one queue is required")
+	}
+
+	names := make(map[string]string)
+	for _, queue := range queues {
+		path, conf := queue.path, queue.config
+
+		id, idPath := conf.Name, path+".name"
+		if conf.URL != "" {
+			id, idPath = conf.URL, path+".url"
+			if err := validateURL(conf.URL); err != nil {
+				add(idPath, "%s", err.Error())
+			}
+		}
+
+		if id == "" {
+			add(path+".name", "is required")
+		} else if other, ok := names[id]; ok {
+			add(idPath, "duplicate queue %q, already defined at %s", id, other)
+		} else {
+			names[id] = path
+		}
+
+		if c.SidekiqQueueFor(conf) == "" {
+			add(path+".sidekiq_queue", "is required when redis.queue is not set")
+		}
+
+		errs = append(errs, validateSQS(path+".sqs", conf.SQS)...)
+
+		// every beat hides messages for the visibility timeout, so it has to
+		// be set or beats could shorten the queue's own timeout
+		if sqs := c.SQSConfigFor(conf); sqs.HeartbeatInterval != 0 && sqs.VisibilityTimeout == 0 {
+			add(path+".sqs.heartbeat_interval", "requires visibility_timeout to be set")
+		} else if sqs.HeartbeatInterval != 0 && sqs.HeartbeatInterval >= sqs.VisibilityTimeout {
+			add(path+".sqs.heartbeat_interval", "must be less than the visibility timeout (%d)", sqs.VisibilityTimeout)
+		}
+
+		if sqs := c.SQSConfigFor(conf); sqs.BackoffBase > sqs.BackoffMax {
+			add(path+".sqs.backoff_base", "must not be more than backoff_max (%d)", sqs.BackoffMax)
+		}
+
+		errs = append(errs, validateFailures(path+".failures", conf.Failures)...)
+
+		switch conf.Format {
+		case "", FormatSNS:
+			if conf.RouteAttribute != "" {
+				add(path+".route_attribute", "is only used by raw queues")
+			}
+
+			if conf.Worker != nil {
+				add(path+".worker", "is only used by raw queues")
+			}
+
+			for i, host := range conf.Signatures.CertHosts {
+				if !validTopicPattern(host) {
+					add(fmt.Sprintf("%s.signatures.cert_hosts[%d]", path, i), "is not a valid host pattern")
+				}
+			}
+
+			if len(conf.Topics) == 0 && len(conf.Routes) == 0 {
+				add(path+".topics", "at least one topic or route is required")
+			}
+		case FormatRaw:
+			if conf.RouteAttribute == "" && conf.Worker == nil && len(conf.Routes) == 0 {
+				add(path, "raw queues need a route_attribute, routes or a worker")
+			}
+
+			if conf.RouteAttribute != "" && len(conf.Topics) == 0 && len(conf.Routes) == 0 {
+				add(path+".topics", "at least one topic is required to route on %s", conf.RouteAttribute)
+			}
+
+			if conf.Worker != nil && strings.TrimSpace(conf.Worker.Class) == "" {
+				add(path+".worker.class", "worker class can't be empty")
+			}
+
+			if conf.Signatures.Verify {
+				add(path+".signatures.verify", "raw messages aren't signed")
+			}
+		default:
+			add(path+".format", "unknown format %q, must be sns or raw", conf.Format)
+		}
+
+		for _, name := range sortedTopics(conf.Topics) {
+			if !validTopicPattern(name) {
+				add(path+".topics."+name, "is not a valid topic pattern")
+			}
+
+			if strings.TrimSpace(conf.Topics[name].Class) == "" {
+				add(path+".topics."+name+".class", "worker class can't be empty")
+			}
+		}
+
+		errs = append(errs, validateRoutes(path+".routes", conf.Routes)...)
+	}
+
+	return errs
+}
+
+// maxRedisTimeout is the longest redis calls can be given, in seconds
+const maxRedisTimeout = 60
+
+// The most receivers and workers scout will run
+const (
+	maxReceivers = 100
+	maxWorkers   = 1000
+)
+
+// validateRoutes checks that every route has something to match on and
+// somewhere to send the messages
+func validateRoutes(path string, routes []RouteConfig) ValidationErrors {
+	var errs ValidationErrors
+
+	for i, route := range routes {
+		routePath := fmt.Sprintf("%s[%d]", path, i)
+
+		if route.Topic == "" && len(route.Attributes) == 0 && len(route.Fields) == 0 {
+			errs = append(errs, ValidationError{routePath, "needs a topic, attributes or fields to match"})
+		}
+
+		if !validTopicPattern(route.Topic) {
+			errs = append(errs, ValidationError{routePath + ".topic", "is not a valid topic pattern"})
+		}
+
+		fields := make([]string, 0, len(route.Fields))
+		for name := range route.Fields {
+			fields = append(fields, name)
+		}
+		sort.Strings(fields)
+
+		for _, name := range fields {
+			if strings.Contains(name, "..") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+				errs = append(errs, ValidationError{routePath + ".fields." + name, "is not a valid field path"})
+			}
+		}
+
+		if len(route.Workers) == 0 {
+			errs = append(errs, ValidationError{routePath + ".workers", "at least one worker is required"})
+		}
+
+		for j, worker := range route.Workers {
+			if strings.TrimSpace(worker.Class) == "" {
+				errs = append(errs, ValidationError{fmt.Sprintf("%s.workers[%d].class", routePath, j), "worker class can't be empty"})
+			}
+		}
+	}
+
+	return errs
+}
+
+// validTopicPattern checks that a topic key is a valid glob if it's a pattern
+func validTopicPattern(key string) bool {
+	_, err := path.Match(key, "")
+	return err == nil
+}
+
+// queuePath is a queue config along with where it came from in the yaml
+type queuePath struct {
+	path   string
+	config QueueConfig
+}
+
+// queuePaths is like QueueConfigs, but keeps track of each queue's path
+func (c *Config) queuePaths() []queuePath {
+	var paths []queuePath
+	if c.Queue.Name != "" || c.Queue.URL != "" || len(c.Queue.Topics) > 0 {
+		paths = append(paths, queuePath{"queue", c.Queue})
+	}
+
+	for i, queue := range c.Queues {
+		paths = append(paths, queuePath{fmt.Sprintf("queues[%d]", i), queue})
+	}
+
+	return paths
+}
+
+func sortedTopics(topics map[string]TopicConfig) []string {
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// validateSQS checks that any SQS settings that are set are in the range SQS
+// accepts
+func validateSQS(path string, sqs SQSConfig) ValidationErrors {
+	var errs ValidationErrors
+	for _, setting := range sqs.settings() {
+		value, ok := setting.get()
+		if ok && (value < setting.min || value > setting.max) {
+			errs = append(errs, ValidationError{
+				path + "." + setting.key,
+				fmt.Sprintf("must be between %d and %d", setting.min, setting.max),
+			})
+		}
+	}
+
+	return errs
+}
+
+// validateFailures checks that every failure policy is one we know, and that
+// there's somewhere to send dead letters if they're used
+func validateFailures(path string, failures FailureConfig) ValidationErrors {
+	var errs ValidationErrors
+
+	policies := failures.policies()
+	classes := make([]string, 0, len(policies))
+	for class := range policies {
+		classes = append(classes, string(class))
+	}
+	sort.Strings(classes)
+
+	for _, class := range classes {
+		switch policy := policies[FailureClass(class)]; policy {
+		case "", PolicyDelete, PolicyLeave:
+		case PolicyDeadLetter:
+			if failures.DeadLetterQueue == "" {
+				errs = append(errs, ValidationError{path + "." + class, "dead_letter requires a dead_letter_queue"})
+			}
+		default:
+			errs = append(errs, ValidationError{
+				path + "." + class,
+				fmt.Sprintf("unknown policy %q, must be one of delete, leave or dead_letter", policy),
+			})
+		}
+	}
+
+	return errs
+}
+
+// validateURL checks that a url is absolute, like http://localhost:9324
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("must be an absolute url, got %q", raw)
+	}
+
+	return nil
+}
+
+// validateHost checks that a redis host looks like host:port
+func validateHost(host string) error {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return fmt.Errorf("must be host:port, got %q", host)
+	}
+
+	if hostname == "" {
+		return fmt.Errorf("missing hostname in %q", host)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", host)
+	}
+
+	return nil
+}
+
+// validateListen checks that a listen address looks like host:port or :port
+func validateListen(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("must be host:port or :port, got %q", addr)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+
+	return nil
+}
+
+// unknownKeys walks the raw yaml alongside the Config type and reports any
+// keys that don't map to a field, as well as any duplicated keys
+func unknownKeys(data []byte) (ValidationErrors, error) {
+	var raw yaml.MapSlice
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	var errs ValidationErrors
+	walkKeys("", raw, reflect.TypeOf(Config{}), &errs)
+	return errs, nil
+}
+
+func walkKeys(path string, node interface{}, t reflect.Type, errs *ValidationErrors) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		mapping, ok := node.(yaml.MapSlice)
+		if !ok {
+			// scalars are fine for types that know how to unmarshal them
+			return
+		}
+
+		fields := yamlFields(t)
+		seen := make(map[string]bool)
+		for _, item := range mapping {
+			key := fmt.Sprint(item.Key)
+			keyPath := joinPath(path, key)
+
+			if seen[key] {
+				*errs = append(*errs, ValidationError{keyPath, "duplicate key"})
+			}
+			seen[key] = true
+
+			field, ok := fields[key]
+			if !ok {
+				*errs = append(*errs, ValidationError{keyPath, "unknown key"})
+				continue
+			}
+
+			walkKeys(keyPath, item.Value, field, errs)
+		}
+	case reflect.Map:
+		mapping, ok := node.(yaml.MapSlice)
+		if !ok {
+			return
+		}
+
+		seen := make(map[string]bool)
+		for _, item := range mapping {
+			key := fmt.Sprint(item.Key)
+			keyPath := joinPath(path, key)
+
+			if seen[key] {
+				*errs = append(*errs, ValidationError{keyPath, "duplicate key"})
+			}
+			seen[key] = true
+
+			walkKeys(keyPath, item.Value, t.Elem(), errs)
+		}
+	case reflect.Slice:
+		items, ok := node.([]interface{})
+		if !ok {
+			return
+		}
+
+		for i, item := range items {
+			walkKeys(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), errs)
+		}
+	}
+}
+
+// yamlFields maps the yaml keys of a struct to their types, following inline
+// fields the same way the yaml package does
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		name := tag[0]
+
+		if len(tag) > 1 && tag[1] == "inline" {
+			for key, inner := range yamlFields(field.Type) {
+				fields[key] = inner
+			}
+			continue
+		}
+
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		fields[name] = field.Type
+	}
+
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	file, err := os.CreateTemp("", "config")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(file.Name()) })
+
+	_, err = file.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	return file.Name()
+}
+
+func TestLoadConfig_Valid(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, validConfig))
+	require.NoError(t, err)
+	require.Equal(t, config.Queue.Name, "myapp_queue")
+}
+
+var invalidConfig = `
+redis:
+  host: "localhost"
+  queue: ""
+  hots: "typo"
+aws:
+  access_key: "super"
+  secret_key: "secret"
+queue:
+  name: "myapp_queue"
+  topics:
+    foo_topic: "FooWorker"
+    foo_topic: "OtherWorker"
+queues:
+  - name: "myapp_queue"
+    topics:
+      bar_topic:
+        class: ""
+        quue: "low"
+  - topics: {}`
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, invalidConfig))
+	require.IsType(t, ValidationErrors{}, err)
+
+	require.Equal(t, ValidationErrors{
+		{"redis.hots", "unknown key"},
+		{"queue.topics.foo_topic", "duplicate key"},
+		{"queues[0].topics.bar_topic.quue", "unknown key"},
+		{"redis.host", `must be host:port, got "localhost"`},
+		{"aws.region", "is required"},
+		{"queue.sidekiq_queue", "is required when redis.queue is not set"},
+		{"queues[0].name", `duplicate queue "myapp_queue", already defined at queue`},
+		{"queues[0].sidekiq_queue", "is required when redis.queue is not set"},
+		{"queues[0].topics.bar_topic.class", "worker class can't be empty"},
+		{"queues[1].name", "is required"},
+		{"queues[1].sidekiq_queue", "is required when redis.queue is not set"},
+		{"queues[1].topics", "at least one topic or route is required"},
+	}, err)
+}
+
+func TestLoadConfig_NoQueues(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, sparseConfig))
+	require.Contains(t, err, ValidationError{"queues", "at least one queue is required"})
+}
+
+func TestLoadConfig_Unparseable(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, "redis: [oops"))
+	require.Error(t, err)
+	_, ok := err.(ValidationErrors)
+	require.False(t, ok)
+}
+
+func TestValidateHost(t *testing.T) {
+	require.NoError(t, validateHost("localhost:6379"))
+	require.NoError(t, validateHost("10.0.0.1:6379"))
+	require.NoError(t, validateHost("[::1]:6379"))
+	require.Error(t, validateHost("localhost"))
+	require.Error(t, validateHost(":6379"))
+	require.Error(t, validateHost("localhost:redis"))
+	require.Error(t, validateHost("localhost:70000"))
+}
+
+func TestValidateCommand(t *testing.T) {
+	out := new(bytes.Buffer)
+	app.Writer = out
+	defer func() { app.Writer = os.Stdout }()
+
+	testFlags := flag.NewFlagSet("testflags", flag.PanicOnError)
+	testFlags.String("config", "", "config to validate")
+
+	// valid configs exit cleanly
+	file := writeConfig(t, validConfig)
+	testFlags.Set("config", file)
+	err := runValidate(cli.NewContext(app, testFlags, nil))
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "is valid")
+
+	// invalid configs print every problem and exit non-zero
+	out.Reset()
+	testFlags.Set("config", writeConfig(t, invalidConfig))
+	err = runValidate(cli.NewContext(app, testFlags, nil))
+	require.Error(t, err)
+	require.Equal(t, 1, err.(cli.ExitCoder).ExitCode())
+	require.Contains(t, out.String(), "redis.hots: unknown key")
+	require.Contains(t, out.String(), "aws.region: is required")
+
+	// missing config is an error
+	testFlags.Set("config", "")
+	err = runValidate(cli.NewContext(app, testFlags, nil))
+	require.Error(t, err)
+}
+
+var sqsConfig = validConfig + `
+sqs:
+  max_number_of_messages: 5
+  wait_time_seconds: 10
+  visibility_timeout: 60`
+
+func TestLoadConfig_SQS(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, sqsConfig))
+	require.NoError(t, err)
+	require.Equal(t, SQSConfig{MaxNumberOfMessages: 5, WaitTimeSeconds: aws.Int64(10), VisibilityTimeout: 60, BackoffBase: DefaultBackoffBase, BackoffMax: DefaultBackoffMax, RequestTimeout: DefaultRequestTimeout}, config.SQSConfigFor(config.Queue))
+
+	// environment variables override the yaml
+	t.Setenv("SCOUT_SQS_WAIT_TIME_SECONDS", "20")
+	t.Setenv("SCOUT_SQS_VISIBILITY_TIMEOUT", "")
+
+	config, err = LoadConfig(writeConfig(t, sqsConfig))
+	require.NoError(t, err)
+	require.Equal(t, SQSConfig{MaxNumberOfMessages: 5, WaitTimeSeconds: aws.Int64(20), VisibilityTimeout: 60, BackoffBase: DefaultBackoffBase, BackoffMax: DefaultBackoffMax, RequestTimeout: DefaultRequestTimeout}, config.SQSConfigFor(config.Queue))
+}
+
+var shortPollConfig = validConfig + `
+sqs:
+  wait_time_seconds: 0
+queues:
+  - name: "other_queue"
+    sqs:
+      wait_time_seconds: 5
+    topics:
+      foo_topic: "FooWorker"`
+
+func TestLoadConfig_ShortPolling(t *testing.T) {
+	// a wait time of 0 is kept rather than replaced with the default
+	config, err := LoadConfig(writeConfig(t, shortPollConfig))
+	require.NoError(t, err)
+	require.Equal(t, aws.Int64(0), config.SQSConfigFor(config.Queue).WaitTimeSeconds)
+	require.Equal(t, aws.Int64(5), config.SQSConfigFor(config.Queues[0]).WaitTimeSeconds)
+
+	// and can be set from the environment too
+	t.Setenv("SCOUT_SQS_WAIT_TIME_SECONDS", "0")
+	config, err = LoadConfig(writeConfig(t, sqsConfig))
+	require.NoError(t, err)
+	require.Equal(t, aws.Int64(0), config.SQSConfigFor(config.Queue).WaitTimeSeconds)
+}
+
+var badSQSConfig = validConfig + `
+sqs:
+  max_number_of_messages: 11
+  wait_time_seconds: -1
+queues:
+  - name: "other_queue"
+    sqs:
+      visibility_timeout: 43201
+    topics:
+      foo_topic: "FooWorker"`
+
+func TestLoadConfig_SQSRanges(t *testing.T) {
+	t.Setenv("SCOUT_SQS_MAX_NUMBER_OF_MESSAGES", "lots")
+	t.Setenv("SCOUT_SQS_WAIT_TIME_SECONDS", "21")
+
+	_, err := LoadConfig(writeConfig(t, badSQSConfig))
+	require.Equal(t, ValidationErrors{
+		{"SCOUT_SQS_MAX_NUMBER_OF_MESSAGES", "must be an integer"},
+		{"SCOUT_SQS_WAIT_TIME_SECONDS", "must be between 0 and 20"},
+		{"sqs.max_number_of_messages", "must be between 1 and 10"},
+		{"sqs.wait_time_seconds", "must be between 0 and 20"},
+		{"queues[0].sqs.visibility_timeout", "must be between 0 and 43200"},
+	}, err)
+}
+
+var heartbeatConfig = validConfig + `
+sqs:
+  heartbeat_interval: 30
+queues:
+  - name: "other_queue"
+    sqs:
+      visibility_timeout: 30
+    topics:
+      foo_topic: "FooWorker"
+  - name: "third_queue"
+    sqs:
+      visibility_timeout: 60
+    topics:
+      foo_topic: "FooWorker"`
+
+func TestLoadConfig_Heartbeat(t *testing.T) {
+	// heartbeats need a visibility timeout that's longer than the interval
+	_, err := LoadConfig(writeConfig(t, heartbeatConfig))
+	require.Equal(t, ValidationErrors{
+		{"queue.sqs.heartbeat_interval", "requires visibility_timeout to be set"},
+		{"queues[0].sqs.heartbeat_interval", "must be less than the visibility timeout (30)"},
+	}, err)
+}
+
+func TestLoadConfig_MissingEnv(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, validConfig+`
+sqs:
+  wait_time_seconds: ${SCOUT_TEST_UNSET_WAIT:-5}
+  visibility_timeout: ${SCOUT_TEST_UNSET_VISIBILITY}`))
+
+	require.Equal(t, ValidationErrors{
+		{"${SCOUT_TEST_UNSET_VISIBILITY}", "environment variable is not set and has no default"},
+	}, err)
+}
+
+func TestValidate_AWS(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	// no static keys is fine, the default chain is used instead
+	config.AWS.AccessKey = ""
+	config.AWS.SecretKey = ""
+	require.Empty(t, config.Validate())
+
+	config.AWS.SecretKey = "secret"
+	config.AWS.RoleARN = "scout"
+	config.AWS.ExternalID = "external"
+	require.Equal(t, ValidationErrors{
+		{"aws.access_key", "is required when aws.secret_key is set"},
+		{"aws.role_arn", `must be an ARN, got "scout"`},
+	}, config.Validate())
+
+	config.AWS.RoleARN = ""
+	require.Contains(t, config.Validate(), ValidationError{"aws.external_id", "requires aws.role_arn"})
+}
+
+var endpointConfig = `
+redis:
+  host: "localhost:6379"
+  queue: "background"
+aws:
+  region: "elasticmq"
+  endpoint: "http://localhost:9324"
+queues:
+  - url: "http://localhost:9324/000000000000/scout"
+    topics:
+      foo_topic: "FooWorker"
+  - url: "localhost/scout"
+    topics:
+      foo_topic: "FooWorker"`
+
+func TestLoadConfig_Endpoint(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, endpointConfig))
+
+	// queues can be given by url instead of name, but it has to be a real url
+	require.Equal(t, ValidationErrors{
+		{"queues[1].url", `must be an absolute url, got "localhost/scout"`},
+	}, err)
+}
+
+func TestValidate_Failures(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	config.Queue.Failures = FailureConfig{
+		InvalidBody:     PolicyDeadLetter,
+		MissingTopicARN: "ignore",
+		UnknownTopic:    PolicyLeave,
+	}
+
+	require.Equal(t, ValidationErrors{
+		{"queue.failures.invalid_body", "dead_letter requires a dead_letter_queue"},
+		{"queue.failures.missing_topic_arn", `unknown policy "ignore", must be one of delete, leave or dead_letter`},
+	}, config.Validate())
+
+	config.Queue.Failures.DeadLetterQueue = "myapp_dlq"
+	config.Queue.Failures.MissingTopicARN = PolicyDelete
+	require.Empty(t, config.Validate())
+}
+
+var rawConfig = `
+redis:
+  host: "localhost:6379"
+  queue: "background"
+aws:
+  region: "us-east-1"
+queues:
+  - name: "events"
+    format: "raw"
+    route_attribute: "event_type"
+    worker: "EventWorker"
+    topics:
+      loan.funded: "FundedWorker"
+  - name: "static"
+    format: "raw"
+    worker:
+      class: "StaticWorker"
+      queue: "low"
+  - name: "broken"
+    format: "raw"
+  - name: "sns"
+    route_attribute: "event_type"
+    topics:
+      foo_topic: "FooWorker"
+  - name: "unknown"
+    format: "xml"`
+
+func TestLoadConfig_Raw(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, rawConfig))
+	require.Equal(t, ValidationErrors{
+		{"queues[2]", "raw queues need a route_attribute, routes or a worker"},
+		{"queues[3].route_attribute", "is only used by raw queues"},
+		{"queues[4].format", `unknown format "xml", must be sns or raw`},
+	}, err)
+
+	require.Equal(t, &TopicConfig{Class: "EventWorker"}, config.Queues[0].Worker)
+	require.Equal(t, &TopicConfig{Class: "StaticWorker", Queue: "low"}, config.Queues[1].Worker)
+}
+
+var routesConfig = `
+redis:
+  host: "localhost:6379"
+  queue: "background"
+aws:
+  region: "us-east-1"
+queues:
+  - name: "events"
+    routes:
+      - topic: "loans"
+        attributes:
+          event_type: "loan.funded"
+        workers:
+          - "FundedWorker"
+          - class: "AuditWorker"
+            queue: "low"
+      - fields:
+          loan.state: "CA"
+        workers: ["CaliforniaWorker"]
+  - name: "broken"
+    topics:
+      "arn:aws:sns:[:111:*": "BadWorker"
+    routes:
+      - workers: []
+      - fields:
+          loan..state: "CA"
+        workers: [""]`
+
+func TestLoadConfig_Routes(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, routesConfig))
+	require.Equal(t, ValidationErrors{
+		{"queues[1].topics.arn:aws:sns:[:111:*", "is not a valid topic pattern"},
+		{"queues[1].routes[0]", "needs a topic, attributes or fields to match"},
+		{"queues[1].routes[0].workers", "at least one worker is required"},
+		{"queues[1].routes[1].fields.loan..state", "is not a valid field path"},
+		{"queues[1].routes[1].workers[0].class", "worker class can't be empty"},
+	}, err)
+
+	require.Equal(t, []RouteConfig{
+		{
+			Topic:      "loans",
+			Attributes: map[string]string{"event_type": "loan.funded"},
+			Workers:    []TopicConfig{{Class: "FundedWorker"}, {Class: "AuditWorker", Queue: "low"}},
+		},
+		{
+			Fields:  map[string]string{"loan.state": "CA"},
+			Workers: []TopicConfig{{Class: "CaliforniaWorker"}},
+		},
+	}, config.Queues[0].Routes)
+}
+
+func TestValidate_Signatures(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	config.Queue.Signatures = SignatureConfig{Verify: true, CertHosts: []string{"certs.example.com", "[.example.com"}}
+	require.Equal(t, ValidationErrors{
+		{"queue.signatures.cert_hosts[1]", "is not a valid host pattern"},
+	}, config.Validate())
+
+	config.Queue.Signatures.CertHosts = nil
+	require.Empty(t, config.Validate())
+
+	config.Queue.Format = FormatRaw
+	config.Queue.Worker = &TopicConfig{Class: "RawWorker"}
+	config.Queue.Topics = nil
+	require.Equal(t, ValidationErrors{
+		{"queue.signatures.verify", "raw messages aren't signed"},
+	}, config.Validate())
+}
+
+func TestValidate_HTTP(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	for _, listen := range []string{":9100", "127.0.0.1:9100", "localhost:0"} {
+		config.HTTP.Listen = listen
+		require.Empty(t, config.Validate(), listen)
+	}
+
+	config.HTTP.Listen = "9100"
+	require.Equal(t, ValidationErrors{
+		{"http.listen", `must be host:port or :port, got "9100"`},
+	}, config.Validate())
+}
+
+func TestValidate_Concurrency(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	require.Equal(t, ConcurrencyConfig{Receivers: DefaultReceivers, Workers: DefaultWorkers}, config.Concurrency.WithDefaults())
+
+	config.Concurrency = ConcurrencyConfig{Receivers: 4, Workers: 50}
+	require.Empty(t, config.Validate())
+	require.Equal(t, config.Concurrency, config.Concurrency.WithDefaults())
+
+	config.Concurrency = ConcurrencyConfig{Receivers: -1, Workers: 5000}
+	require.Equal(t, ValidationErrors{
+		{"concurrency.receivers", "must be between 1 and 100"},
+		{"concurrency.workers", "must be between 1 and 1000"},
+	}, config.Validate())
+}
+
+func TestValidate_Timeouts(t *testing.T) {
+	config, err := parseConfig([]byte(validConfig))
+	require.NoError(t, err)
+
+	require.Equal(t, DefaultRedisTimeout*time.Second, config.Redis.CallTimeout())
+
+	config.Redis.Timeout = 2
+	config.SQS.RequestTimeout = 30
+	require.Empty(t, config.Validate())
+	require.Equal(t, 2*time.Second, config.Redis.CallTimeout())
+
+	config.Redis.Timeout = 120
+	config.SQS.RequestTimeout = -1
+	require.Equal(t, ValidationErrors{
+		{"redis.timeout", "must be between 1 and 60"},
+		{"sqs.request_timeout", "must be between 0 and 3600"},
+	}, config.Validate())
+}
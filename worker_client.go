@@ -1,32 +1,59 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
+	redigo "github.com/garyburd/redigo/redis"
 	"github.com/jrallison/go-workers"
 )
 
 // WorkerClient is an interface for enqueueing workers
 type WorkerClient interface {
-	// Push pushes a worker onto the queue
-	Push(class, args string) (string, error)
+	// Push pushes a job onto its sidekiq queue, giving up when the context
+	// is done
+	Push(ctx context.Context, job Job) (string, error)
+}
+
+// Job is a single sidekiq job to be enqueued
+type Job struct {
+	Queue string
+	Class string
+	Args  string
+	JobOptions
+}
+
+// jobPayload is the json sidekiq expects to find in redis
+type jobPayload struct {
+	Queue      string             `json:"queue"`
+	Class      string             `json:"class"`
+	Args       []*json.RawMessage `json:"args"`
+	Jid        string             `json:"jid"`
+	CreatedAt  float64            `json:"created_at"`
+	EnqueuedAt float64            `json:"enqueued_at,omitempty"`
+	Retry      *BoolOrInt         `json:"retry,omitempty"`
+	Dead       *bool              `json:"dead,omitempty"`
+	Backtrace  *BoolOrInt         `json:"backtrace,omitempty"`
+	At         float64            `json:"at,omitempty"`
 }
 
 type redisWorkerClient struct {
-	queue string
+	timeout time.Duration
 }
 
-// NewRedisWorkerClient creates a worker client that pushes the worker to redis
+// NewRedisWorkerClient creates a worker client that pushes the worker to redis.
+// The underlying connection pool is global, so a single client should be
+// shared between all the queues. Connecting, and every call after that, is
+// limited to the redis timeout.
 func NewRedisWorkerClient(redis RedisConfig) (WorkerClient, error) {
 	if redis.Host == "" {
 		return nil, errors.New("Redis host required")
 	}
 
-	if redis.Queue == "" {
-		return nil, errors.New("Sidekiq queue required")
-	}
-
 	workerConfig := map[string]string{
 		"server":   redis.Host,
 		"database": "0",
@@ -43,19 +70,153 @@ func NewRedisWorkerClient(redis RedisConfig) (WorkerClient, error) {
 	}
 
 	workers.Configure(workerConfig)
+	workers.Config.Pool.Dial = dialRedis(redis, redis.CallTimeout())
 
-	return &redisWorkerClient{queue: redis.Queue}, nil
+	return &redisWorkerClient{timeout: redis.CallTimeout()}, nil
 }
 
-func (r *redisWorkerClient) Push(class, args string) (string, error) {
+// dialRedis connects the same way go-workers does, but with timeouts so a
+// hung redis can't block a connection forever
+func dialRedis(conf RedisConfig, timeout time.Duration) func() (redigo.Conn, error) {
+	return func() (redigo.Conn, error) {
+		return redigo.Dial("tcp", conf.Host,
+			redigo.DialConnectTimeout(timeout),
+			redigo.DialReadTimeout(timeout),
+			redigo.DialWriteTimeout(timeout),
+			redigo.DialPassword(conf.Password),
+		)
+	}
+}
+
+// Push enqueues the job the same way sidekiq's client does. Jobs that are
+// scheduled for later go in the schedule set instead of the queue.
+func (r *redisWorkerClient) Push(ctx context.Context, job Job) (string, error) {
+	jid, err := generateJID()
+	if err != nil {
+		return "", err
+	}
+
 	// This will hopefully deserialize on the ruby end as a hash
-	jsonArgs := json.RawMessage([]byte(args))
-	return workers.EnqueueWithOptions(
-		r.queue,
-		class,
-		[]*json.RawMessage{&jsonArgs},
-		workers.EnqueueOptions{
-			Retry: true,
-		},
-	)
+	jsonArgs := json.RawMessage([]byte(job.Args))
+	now := time.Now()
+
+	payload := jobPayload{
+		Queue:     job.Queue,
+		Class:     job.Class,
+		Args:      []*json.RawMessage{&jsonArgs},
+		Jid:       jid,
+		CreatedAt: unixSeconds(now),
+		Retry:     job.Retry,
+		Dead:      job.Dead,
+		Backtrace: job.Backtrace,
+	}
+
+	at := job.scheduledAt(now)
+	if at.After(now) {
+		payload.At = unixSeconds(at)
+	} else {
+		payload.EnqueuedAt = payload.CreatedAt
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err = r.push(ctx, job.Queue, payload.At, data)
+	metrics.RedisPush.WithLabelValues(job.Queue).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues(job.Queue).Inc()
+		return "", err
+	}
+
+	return jid, nil
+}
+
+// push writes the job's payload to redis. Scheduled jobs go in the schedule
+// set, and everything else on the end of its queue
+func (r *redisWorkerClient) push(ctx context.Context, queue string, at float64, data []byte) error {
+	conn, err := workers.Config.Pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if at != 0 {
+		_, err := doContext(ctx, conn, "zadd", workers.Config.Namespace+workers.SCHEDULED_JOBS_KEY, at, data)
+		return err
+	}
+
+	_, err = doContext(ctx, conn, "sadd", workers.Config.Namespace+"queues", queue)
+	if err != nil {
+		return err
+	}
+
+	_, err = doContext(ctx, conn, "rpush", workers.Config.Namespace+"queue:"+queue, data)
+	return err
+}
+
+// doContext runs a redis command, waiting for the reply for no longer than
+// the context has left
+func doContext(ctx context.Context, conn redigo.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return conn.Do(cmd, args...)
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	return redigo.DoWithTimeout(conn, timeout, cmd, args...)
+}
+
+// PingRedis checks that redis can be reached with the shared pool, giving up
+// after the timeout
+func PingRedis(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := workers.Config.Pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = doContext(ctx, conn, "ping")
+	return err
+}
+
+// scheduledAt returns when the job should run. It's the zero time if the job
+// should run right away
+func (j Job) scheduledAt(now time.Time) time.Time {
+	if j.In > 0 {
+		return now.Add(j.In)
+	}
+
+	return j.At
+}
+
+// generateJID returns 12 random bytes as 24 hex characters, like sidekiq
+func generateJID() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", b), nil
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
 }
@@ -3,8 +3,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/jrallison/go-workers"
 	"github.com/stretchr/testify/require"
@@ -35,7 +37,7 @@ func TestWorker_Init(t *testing.T) {
 	)
 	require.Error(t, err)
 
-	// no queue
+	// no queue, this doesn't error since queues can set their own
 	_, err = NewRedisWorkerClient(
 		RedisConfig{
 			Host:      "localhost:6379",
@@ -43,7 +45,7 @@ func TestWorker_Init(t *testing.T) {
 			Queue:     "",
 		},
 	)
-	require.Error(t, err)
+	require.NoError(t, err)
 
 	// no namespace, this doesn't error
 	_, err = NewRedisWorkerClient(
@@ -81,12 +83,13 @@ func TestWorker_Push(t *testing.T) {
 	client, err := NewRedisWorkerClient(config)
 	require.NoError(t, err)
 
+	retry := JobOptions{Retry: &BoolOrInt{Enabled: true}}
 	fooMessage := `{"msg":"foo"}`
 	barMessage := `{"msg":"bar"}`
 
-	fooJID, err := client.Push("FooWorker", fooMessage)
+	fooJID, err := client.Push(context.Background(), Job{Queue: config.Queue, Class: "FooWorker", Args: fooMessage, JobOptions: retry})
 	require.NoError(t, err)
-	barJID, err := client.Push("BarWorker", barMessage)
+	barJID, err := client.Push(context.Background(), Job{Queue: config.Queue, Class: "BarWorker", Args: barMessage, JobOptions: retry})
 	require.NoError(t, err)
 
 	require.NotEqual(t, fooJID, barJID)
@@ -124,3 +127,44 @@ func TestWorker_Push(t *testing.T) {
 
 	require.Equal(t, barFlat["retry"], true)
 }
+
+func TestWorker_PushScheduled(t *testing.T) {
+	redisHandle := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	err := redisHandle.Del("integration:schedule").Err()
+	require.NoError(t, err)
+
+	client, err := NewRedisWorkerClient(config)
+	require.NoError(t, err)
+
+	noDead := false
+	jid, err := client.Push(context.Background(), Job{
+		Queue: config.Queue,
+		Class: "FooWorker",
+		Args:  `{"msg":"foo"}`,
+		JobOptions: JobOptions{
+			Retry: &BoolOrInt{Enabled: true, Count: 3},
+			Dead:  &noDead,
+			In:    time.Minute,
+		},
+	})
+	require.NoError(t, err)
+
+	// scheduled jobs go in the schedule set instead of the queue
+	data, err := redisHandle.ZRange("integration:schedule", 0, -1).Result()
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+
+	flat := make(map[string]interface{})
+	err = json.Unmarshal([]byte(data[0]), &flat)
+	require.NoError(t, err)
+
+	require.Equal(t, flat["jid"], jid)
+	require.Equal(t, flat["retry"], float64(3))
+	require.Equal(t, flat["dead"], false)
+	require.NotContains(t, flat, "enqueued_at")
+}